@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// runCheck implements `discodex check [path]`: it prints every problem in the
+// config file as path:line and returns the exit code (1 when there are errors).
+func runCheck(args []string) int {
+	path := config.Path()
+	if len(args) > 0 {
+		path = args[0]
+	}
+	_, issues, err := config.Check(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	errs := 0
+	for _, is := range issues {
+		if !is.Warning {
+			errs++
+		}
+		if is.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", path, is.Line, is)
+		} else {
+			fmt.Printf("%s: %s\n", path, is)
+		}
+	}
+	if errs > 0 {
+		fmt.Printf("%d 件のエラー、%d 件の警告\n", errs, len(issues)-errs)
+		return 1
+	}
+	if len(issues) > 0 {
+		fmt.Printf("エラーなし（%d 件の警告）\n", len(issues))
+	} else {
+		fmt.Println("OK")
+	}
+	return 0
+}
@@ -2,31 +2,40 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/aoisensi/discodex/internal/codex"
 	"github.com/aoisensi/discodex/internal/config"
 	"github.com/aoisensi/discodex/internal/discordbot"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/aoisensi/discodex/internal/metrics"
+	"github.com/aoisensi/discodex/internal/store"
 )
 
 func main() {
-	log.Println("hi")
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(runCheck(os.Args[2:]))
+	}
 	// 設定ロード（必須）
 	conf, err := config.LoadDefault()
 	if err != nil {
-		log.Fatalf("config load: %v", err)
+		fatal("config load", err)
 	}
+	// ログ（[log] / DISCODEX_LOG_LEVEL / DISCODEX_LOG_FORMAT）
+	logging.Setup(conf)
 	if conf.Discord.BotToken == "" {
-		log.Fatal("discord.bot_token が未設定 (TOML)")
+		fatal("config load", errors.New("discord.bot_token が未設定 (TOML)"))
 	}
 
 	bot, err := discordbot.New(conf.Discord.BotToken, conf.Discord.GuildID)
 	if err != nil {
-		log.Fatalf("bot init: %v", err)
+		fatal("bot init", err)
 	}
 	// チャンネル→設定のマップ
 	cmap := map[string]config.Channel{}
@@ -34,47 +43,89 @@ func main() {
 		cmap[ch.ChannelID] = ch
 	}
 
-	// Codexクライアント（MCP常駐）
-	runner := codex.NewMCPBridge(conf.Codex)
-	// Reasoning -> Discord presence
-	runner.WithReasoningHandler(
-		func(channelID, text string) { bot.SetReasoningStatus(text) },
-		func(channelID string) { bot.ClearStatus() },
-	)
-	// Streaming agent_message -> Discord message edit
-	runner.WithStreamHandler(
-		func(channelID string, requestID int64, delta string) {
-			bot.ApplyStreamDelta(channelID, requestID, delta)
-		},
-		func(channelID string, requestID int64, final string) { bot.EndStream(channelID, requestID, final) },
-	)
-	// MCP lifecycle -> Presence
-	runner.WithStateHandler(
-		func() { bot.ClearStatus() }, // up: online, no special activity
-		func() { bot.SetAway() },     // down: away/退出中
-	)
+	// 会話IDなどの永続化
+	st, err := store.New(conf.State)
+	if err != nil {
+		fatal("state", err)
+	}
+	bot.WithStore(st)
+
+	// Codexクライアント（チャンネルごとに mcp / interactive / stub を選択）
+	mcp := codex.NewMCPBridge(conf.Codex).WithStore(st).WithQuota(conf.Quota)
+	runner := codex.NewRouter(conf.Codex, mcp, codex.NewInteractiveTailBridge(conf.Codex), codex.NewClient())
+	runner.SetHandlers(codex.Handlers{
+		// Reasoning -> Discord presence
+		Reasoning:    func(channelID, text string) { bot.SetReasoningStatus(text) },
+		ReasoningEnd: func(channelID string) { bot.ClearStatus() },
+		// Streaming agent_message -> Discord message edit
+		Delta: bot.ApplyStreamDelta,
+		Done:  bot.EndStream,
+		// exec/patch/MCP tool/plan/diff events -> embeds
+		Event: bot.HandleEvent,
+		// cancelled turn -> finalize partial stream
+		Cancelled: bot.CancelStream,
+		// exec/patch approval -> Discord buttons
+		Approval: bot.RequestApproval,
+		// process lifecycle -> Presence
+		Up:   func() { bot.ClearStatus() }, // up: online, no special activity
+		Down: func() { bot.SetAway() },     // down: away/退出中
+		// crash loop -> notice to the affected channels
+		GaveUp: bot.NotifyGaveUp,
+		// unexpected exit -> log channel, with the end of stderr
+		Exited: bot.ReportExit,
+	})
 	chatFn := func(ctx context.Context, ch config.Channel, prompt string) ([]string, error) {
 		return runner.ChatMulti(ctx, ch, prompt)
 	}
 
-	bot.WithChannelMap(cmap).WithLogChannel(conf.Discord.LogChannelID).WithChatHandler(chatFn).WithResetHandler(func(ctx context.Context, ch config.Channel) error {
-		// Clear conversation state in MCP and return
-		runner.Reset(ch.ChannelID)
-		return nil
-	})
+	bot.WithChannelMap(cmap).WithLogChannel(conf.Discord.LogChannelID).WithAttachments(conf.Attachments).WithArtifacts(conf.Artifacts).WithACL(conf.ACL).WithCodex(conf.Codex).WithChatHandler(chatFn).WithResetHandler(func(ctx context.Context, ch config.Channel) error {
+		// Clear conversation state in MCP; refused while a turn is running or queued
+		return runner.Reset(ch.ChannelID)
+	}).WithStatusHandler(runner.Status).WithCancelHandler(func(ch config.Channel) bool {
+		return runner.Cancel(ch.ChannelID)
+	}).WithUsageHandler(runner.Usage)
+
+	// Prometheus メトリクス（metrics_addr 指定時のみ）
+	metricsCtx, stopMetrics := context.WithCancel(context.Background())
+	if addr := strings.TrimSpace(conf.MetricsAddr); addr != "" {
+		metrics.OnCollect(mcp.CollectMetrics)
+		go func() {
+			if err := metrics.Serve(metricsCtx, addr); err != nil {
+				bot.ReportError("metrics", err)
+			}
+		}()
+	}
+
+	// discodex.toml の変更を検知して再読み込み（SIGHUP でも可）
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	go watchConfig(watchCtx, config.Path(), conf, func(next *config.Config) {
+		logging.SetLevel(next)
+		bot.Reload(next)
+		// channels moved by /codex cwd keep their processes too
+		runner.Reload(next.Codex, next.Quota, bot.Channels())
+	}, func(err error) { bot.ReportError("config", err) })
 
 	// Run with graceful shutdown support
 	go func() {
 		if err := bot.Run(); err != nil {
-			log.Printf("bot run ended: %v", err)
+			slog.Error("bot run ended", "error", err)
 		}
 	}()
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	<-sig
 	// graceful shutdown
-	log.Println("shutdown...")
+	slog.Info("shutdown...")
+	stopWatch()
+	stopMetrics()
 	runner.Close()
 	bot.Stop()
+	_ = st.Close()
 	time.Sleep(300 * time.Millisecond)
 }
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
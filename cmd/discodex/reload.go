@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// configPollInterval is how often the config file's mtime is checked.
+const configPollInterval = 2 * time.Second
+
+// watchConfig reloads the config file when it changes on disk or on SIGHUP.
+// A file that fails to load is reported through onError and the previous
+// configuration stays in effect.
+func watchConfig(ctx context.Context, path string, cur *config.Config, apply func(*config.Config), onError func(error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	last := fileStamp(path)
+	tick := time.NewTicker(configPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			slog.Info("config: SIGHUP, reloading", "path", path)
+		case <-tick.C:
+			s := fileStamp(path)
+			if s == last {
+				continue
+			}
+			last = s
+		}
+		next, err := config.Load(path)
+		if err != nil {
+			onError(fmt.Errorf("再読み込みに失敗（前の設定のまま）: %w", err))
+			continue
+		}
+		if next.Discord.BotToken != cur.Discord.BotToken || next.Discord.GuildID != cur.Discord.GuildID {
+			onError(errors.New("discord.bot_token / discord.guild_id の変更は再起動後に反映"))
+		}
+		if next.State != cur.State {
+			onError(errors.New("[state] の変更は再起動後に反映"))
+		}
+		if next.MetricsAddr != cur.MetricsAddr {
+			onError(errors.New("metrics_addr の変更は再起動後に反映"))
+		}
+		if next.Log.Format != cur.Log.Format {
+			onError(errors.New("log.format の変更は再起動後に反映"))
+		}
+		apply(next)
+		cur = next
+		slog.Info("config: reloaded", "path", path)
+	}
+}
+
+type stamp struct {
+	mod  time.Time
+	size int64
+}
+
+func fileStamp(path string) stamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{mod: fi.ModTime(), size: fi.Size()}
+}
@@ -0,0 +1,216 @@
+package codex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/logging"
+)
+
+// ApprovalKind tells what Codex is asking permission for.
+type ApprovalKind string
+
+const (
+	ApprovalExec  ApprovalKind = "exec"
+	ApprovalPatch ApprovalKind = "patch"
+)
+
+// ApprovalDecision is the answer sent back to Codex (ReviewDecision).
+type ApprovalDecision string
+
+const (
+	DecisionApproved           ApprovalDecision = "approved"
+	DecisionApprovedForSession ApprovalDecision = "approved_for_session"
+	DecisionDenied             ApprovalDecision = "denied"
+	DecisionAbort              ApprovalDecision = "abort"
+)
+
+// ApprovalRequest is an exec or apply-patch elicitation raised by Codex.
+type ApprovalRequest struct {
+	ChannelID string
+	// tools/call request id the elicitation belongs to
+	RequestID int64
+	Kind      ApprovalKind
+	Message   string
+	// exec: shell-quoted command line and its working directory
+	Command string
+	Cwd     string
+	// patch: reason given by Codex and the rendered changes
+	Reason string
+	Diff   string
+}
+
+// WithApprovalHandler registers the callback that decides exec/patch approvals.
+// The context passed to fn expires after approval_timeout_seconds, or is
+// cancelled with cause ErrCancelled when the turn is cancelled; without a
+// handler every request is denied.
+func (m *MCPBridge) WithApprovalHandler(fn func(ctx context.Context, req ApprovalRequest) ApprovalDecision) *MCPBridge {
+	m.onApproval = fn
+	return m
+}
+
+// handleServerRequest answers JSON-RPC requests initiated by the server.
+func (m *MCPBridge) handleServerRequest(p *mcpProc, id any, raw map[string]any) {
+	method, _ := raw["method"].(string)
+	if method == "ping" {
+		_ = p.respond(id, map[string]any{})
+		return
+	}
+	if method != "elicitation/create" {
+		_ = p.respondError(id, -32601, "method not found: "+method)
+		return
+	}
+	params, _ := raw["params"].(map[string]any)
+	req, ok := parseApprovalRequest(params)
+	if !ok {
+		_ = p.respondError(id, -32602, "unsupported elicitation")
+		return
+	}
+	var abort <-chan struct{}
+	if rid, ok := requestIDOf(params["codex_mcp_tool_call_id"]); ok {
+		req.RequestID = rid
+		req.ChannelID = p.owner(rid)
+		abort = p.abortOf(rid)
+	}
+	// the decision may take minutes; never block readLoop
+	go func() {
+		decision := DecisionDenied
+		if m.onApproval != nil && req.ChannelID != "" {
+			to := m.codexConf().ApprovalTimeoutSeconds
+			if to <= 0 {
+				to = 300
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(to)*time.Second)
+			// a cancelled turn takes its pending approval with it
+			ctx, cancelTurn := context.WithCancelCause(ctx)
+			if abort != nil {
+				go func() {
+					select {
+					case <-abort:
+						cancelTurn(ErrCancelled)
+					case <-ctx.Done():
+					}
+				}()
+			}
+			decision = m.onApproval(ctx, req)
+			if errors.Is(context.Cause(ctx), ErrCancelled) {
+				decision = DecisionAbort
+			}
+			cancelTurn(nil)
+			cancel()
+		}
+		slog.Debug("mcp: approval", logging.KeyChannel, req.ChannelID, logging.KeyRPC, req.RequestID, "kind", req.Kind, "decision", decision)
+		_ = p.respond(id, map[string]any{"decision": decision})
+	}()
+}
+
+func parseApprovalRequest(params map[string]any) (ApprovalRequest, bool) {
+	var req ApprovalRequest
+	req.Message, _ = params["message"].(string)
+	switch params["codex_elicitation"] {
+	case "exec-approval":
+		req.Kind = ApprovalExec
+		req.Command = joinCommand(params["codex_command"])
+		req.Cwd, _ = params["codex_cwd"].(string)
+	case "patch-approval":
+		req.Kind = ApprovalPatch
+		req.Reason, _ = params["codex_reason"].(string)
+		changes, _ := params["codex_changes"].(map[string]any)
+		req.Diff = renderChanges(changes)
+	default:
+		return req, false
+	}
+	return req, true
+}
+
+// requestIDOf accepts both numeric and string JSON-RPC ids.
+func requestIDOf(v any) (int64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return int64(t), true
+	case string:
+		if id, err := parseID(t); err == nil {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// joinCommand renders an argv array as a readable shell line.
+func joinCommand(v any) string {
+	arr, _ := v.([]any)
+	parts := make([]string, 0, len(arr))
+	for _, a := range arr {
+		s := fmt.Sprintf("%v", a)
+		if s == "" || strings.ContainsAny(s, " \t\n'\"\\$`|&;<>()*?") {
+			s = "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+// renderChanges turns Codex FileChange entries into a unified-diff-like text.
+func renderChanges(changes map[string]any) string {
+	paths := make([]string, 0, len(changes))
+	for p := range changes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, path := range paths {
+		c, _ := changes[path].(map[string]any)
+		switch {
+		case c["add"] != nil:
+			add, _ := c["add"].(map[string]any)
+			content, _ := add["content"].(string)
+			fmt.Fprintf(&b, "--- /dev/null\n+++ %s\n", path)
+			for _, l := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+				b.WriteString("+" + l + "\n")
+			}
+		case c["delete"] != nil:
+			fmt.Fprintf(&b, "--- %s\n+++ /dev/null\n", path)
+		case c["update"] != nil:
+			upd, _ := c["update"].(map[string]any)
+			dst := path
+			if mv, _ := upd["move_path"].(string); mv != "" {
+				dst = mv
+			}
+			diff, _ := upd["unified_diff"].(string)
+			fmt.Fprintf(&b, "--- %s\n+++ %s\n%s", path, dst, diff)
+			if !strings.HasSuffix(diff, "\n") {
+				b.WriteString("\n")
+			}
+		}
+	}
+	return b.String()
+}
+
+func (p *mcpProc) respond(id any, result any) error {
+	return p.writeMessage(map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func (p *mcpProc) respondError(id any, code int, msg string) error {
+	return p.writeMessage(map[string]any{"jsonrpc": "2.0", "id": id, "error": map[string]any{"code": code, "message": msg}})
+}
+
+func (p *mcpProc) writeMessage(v map[string]any) error {
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin == nil {
+		return fmt.Errorf("mcp process not running")
+	}
+	b, _ := json.Marshal(v)
+	if logging.Debug() {
+		slog.Debug("mcp =>", "line", truncate(string(b), 240))
+	}
+	_, err := stdin.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,57 @@
+package codex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+func TestApprovalEndsWithCancelledTurn(t *testing.T) {
+	m := NewMCPBridge(config.Codex{ApprovalTimeoutSeconds: 30})
+	cause := make(chan error, 1)
+	m.WithApprovalHandler(func(ctx context.Context, req ApprovalRequest) ApprovalDecision {
+		<-ctx.Done()
+		cause <- context.Cause(ctx)
+		return DecisionApproved
+	})
+	p := newMCPProc(m, "k", config.Codex{}, config.Channel{})
+	pr, pw := io.Pipe()
+	p.stdin = pw
+	abort := make(chan struct{})
+	p.owners[7] = "1"
+	p.cancels[7] = abort
+
+	m.handleServerRequest(p, 3, map[string]any{
+		"method": "elicitation/create",
+		"params": map[string]any{
+			"codex_elicitation":      "exec-approval",
+			"codex_command":          []any{"ls"},
+			"codex_mcp_tool_call_id": "7",
+		},
+	})
+	close(abort)
+
+	if err := <-cause; !errors.Is(err, ErrCancelled) {
+		t.Errorf("handler context cause = %v, want ErrCancelled", err)
+	}
+	line, err := bufio.NewReader(pr).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Result struct {
+			Decision ApprovalDecision `json:"decision"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Decision != DecisionAbort {
+		t.Errorf("decision = %q, want %q", resp.Result.Decision, DecisionAbort)
+	}
+}
@@ -0,0 +1,185 @@
+package codex
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/metrics"
+)
+
+// Backend runs Codex turns for channels. MCPBridge, InteractiveTailBridge and
+// the stub Client implement it; Router picks one per channel.
+type Backend interface {
+	Chat(ctx context.Context, ch config.Channel, prompt string) (string, error)
+	// ChatMulti runs one turn. Replies that were already streamed through
+	// Handlers are not returned.
+	ChatMulti(ctx context.Context, ch config.Channel, prompt string) ([]string, error)
+	// Reset forgets the channel's conversation; ErrBusy while one of its turns
+	// is running or queued.
+	Reset(channelID string) error
+	// Cancel aborts the channel's running turn; false when nothing was running
+	// or the backend cannot cancel.
+	Cancel(channelID string) bool
+	Status(ch config.Channel) Status
+	// Close stops every process the backend started.
+	Close()
+	// SetHandlers registers the streaming, reasoning, event and lifecycle callbacks.
+	SetHandlers(h Handlers)
+}
+
+// Handlers are the callbacks a Backend reports to. Any of them may be nil.
+type Handlers struct {
+	Reasoning    func(channelID, text string)
+	ReasoningEnd func(channelID string)
+	Delta        func(channelID string, requestID int64, delta string)
+	Done         func(channelID string, requestID int64, final string)
+	Cancelled    func(channelID string, requestID int64)
+	Event        func(channelID string, requestID int64, ev Event)
+	Approval     func(ctx context.Context, req ApprovalRequest) ApprovalDecision
+	// Up fires when a process comes up, Down once the last one has exited.
+	Up   func()
+	Down func()
+	// GaveUp fires when a process kept crashing and is not restarted for a
+	// while; channelIDs are the channels it served.
+	GaveUp func(channelIDs []string, err error)
+	// Exited fires when a process exits without discodex stopping it.
+	Exited func(err *ExitError)
+}
+
+var (
+	_ Backend = (*MCPBridge)(nil)
+	_ Backend = (*InteractiveTailBridge)(nil)
+	_ Backend = (*Client)(nil)
+	_ Backend = (*Router)(nil)
+)
+
+// SetHandlers registers every callback at once.
+func (m *MCPBridge) SetHandlers(h Handlers) {
+	m.WithReasoningHandler(h.Reasoning, h.ReasoningEnd)
+	m.WithStreamHandler(h.Delta, h.Done)
+	m.WithCancelHandler(h.Cancelled)
+	m.WithEventHandler(h.Event)
+	m.WithApprovalHandler(h.Approval)
+	m.WithStateHandler(h.Up, h.Down)
+	m.WithGiveUpHandler(h.GaveUp)
+	m.WithExitHandler(h.Exited)
+}
+
+// Router sends each channel to the backend its configuration selects
+// (`backend = "mcp" | "interactive" | "stub"`).
+type Router struct {
+	mcp         *MCPBridge
+	interactive *InteractiveTailBridge
+	stub        *Client
+
+	mu   sync.RWMutex
+	conf config.Codex
+}
+
+func NewRouter(conf config.Codex, mcp *MCPBridge, interactive *InteractiveTailBridge, stub *Client) *Router {
+	// the MCP backend keeps the usage counters and budgets for both
+	interactive.usage = mcp
+	return &Router{conf: conf, mcp: mcp, interactive: interactive, stub: stub}
+}
+
+func (r *Router) backend(ch config.Channel) Backend {
+	r.mu.RLock()
+	name := r.conf.BackendFor(ch)
+	r.mu.RUnlock()
+	switch name {
+	case config.BackendInteractive:
+		return r.interactive
+	case config.BackendStub:
+		return r.stub
+	}
+	return r.mcp
+}
+
+func (r *Router) all() []Backend {
+	return []Backend{r.mcp, r.interactive, r.stub}
+}
+
+func (r *Router) Chat(ctx context.Context, ch config.Channel, prompt string) (string, error) {
+	return r.backend(ch).Chat(ctx, ch, prompt)
+}
+
+func (r *Router) ChatMulti(ctx context.Context, ch config.Channel, prompt string) ([]string, error) {
+	r.mu.RLock()
+	name := r.conf.BackendFor(ch)
+	r.mu.RUnlock()
+	start := time.Now()
+	replies, err := r.backend(ch).ChatMulti(ctx, ch, prompt)
+	result := "ok"
+	var qe *QuotaError
+	switch {
+	case errors.Is(err, ErrCancelled):
+		result = "cancelled"
+	case errors.As(err, &qe):
+		result = "quota"
+	case err != nil:
+		result = "error"
+	}
+	metrics.Requests.Inc(budgetChannel(ch), name, result)
+	metrics.RequestDuration.ObserveSince(start, budgetChannel(ch), name)
+	return replies, err
+}
+
+// Reset and Cancel only know the channel id, so every backend is asked; a
+// backend that never ran the channel ignores it.
+func (r *Router) Reset(channelID string) error {
+	var errs []error
+	for _, b := range r.all() {
+		errs = append(errs, b.Reset(channelID))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Router) Cancel(channelID string) bool {
+	cancelled := false
+	for _, b := range r.all() {
+		if b.Cancel(channelID) {
+			cancelled = true
+		}
+	}
+	return cancelled
+}
+
+func (r *Router) Status(ch config.Channel) Status {
+	return r.backend(ch).Status(ch)
+}
+
+func (r *Router) Close() {
+	for _, b := range r.all() {
+		b.Close()
+	}
+}
+
+func (r *Router) SetHandlers(h Handlers) {
+	for _, b := range r.all() {
+		b.SetHandlers(h)
+	}
+}
+
+// Usage reports token usage. The MCP backend keeps the counters of the
+// interactive backend too.
+func (r *Router) Usage(ch config.Channel, userID string) UsageReport {
+	return r.mcp.Usage(ch, userID)
+}
+
+// Reload swaps in new settings for every backend.
+func (r *Router) Reload(conf config.Codex, quota config.Quota, channels []config.Channel) {
+	r.mu.Lock()
+	r.conf = conf
+	r.mu.Unlock()
+	var mcpChannels []config.Channel
+	for _, ch := range channels {
+		if conf.BackendFor(ch) == config.BackendMCP {
+			mcpChannels = append(mcpChannels, ch)
+		}
+	}
+	r.mcp.Reload(conf, quota, mcpChannels)
+	r.interactive.Reload(conf)
+}
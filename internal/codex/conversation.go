@@ -0,0 +1,80 @@
+package codex
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+// convoState is a conversation plus the process generation it lives on.
+type convoState struct {
+	store.Conversation
+	// gen is the generation of the process that owns the conversation; 0 means
+	// it was restored from the store and has not been resumed yet.
+	gen int64
+}
+
+// WithStore enables persistence and restores saved conversations. Restored
+// conversations are resumed (codex-reply or session resume) on first use.
+func (m *MCPBridge) WithStore(s store.Store) *MCPBridge {
+	m.store = s
+	if s == nil {
+		return m
+	}
+	convos, err := s.Conversations()
+	if err != nil {
+		slog.Error("state: load conversations", "error", err)
+		return m
+	}
+	for _, c := range convos {
+		if c.Key == "" || c.ConversationID == "" {
+			continue
+		}
+		m.convo.Store(c.Key, convoState{Conversation: c})
+	}
+	slog.Debug("state: restored conversations", "count", len(convos))
+	return m
+}
+
+func (m *MCPBridge) conversation(key string) (convoState, bool) {
+	v, ok := m.convo.Load(key)
+	if !ok {
+		return convoState{}, false
+	}
+	return v.(convoState), true
+}
+
+func (m *MCPBridge) saveConversation(cs convoState) {
+	if cs.CreatedAt.IsZero() {
+		cs.CreatedAt = time.Now()
+	}
+	m.convo.Store(cs.Key, cs)
+	if m.store == nil {
+		return
+	}
+	if err := m.store.PutConversation(cs.Conversation); err != nil {
+		slog.Error("state: save conversation", logging.KeyChannel, cs.Key, logging.KeyConversation, cs.ConversationID, "error", err)
+	}
+}
+
+// forget drops the conversation for key from memory and the store.
+func (m *MCPBridge) forget(key string) {
+	m.convo.Delete(key)
+	if m.store == nil {
+		return
+	}
+	if err := m.store.DeleteConversation(key); err != nil {
+		slog.Error("state: delete conversation", logging.KeyChannel, key, "error", err)
+	}
+}
+
+// takeRollout returns and clears the session file recorded for a request.
+func (m *MCPBridge) takeRollout(id int64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := m.rollouts[id]
+	delete(m.rollouts, id)
+	return path
+}
@@ -0,0 +1,341 @@
+package codex
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event categories; each can be toggled per channel with [channels.events].
+const (
+	CategoryExec      = "exec"
+	CategoryPatch     = "patch"
+	CategoryMCP       = "mcp"
+	CategoryWebSearch = "web_search"
+	CategoryDiff      = "diff"
+	CategoryPlan      = "plan"
+	// CategoryTurn is bookkeeping (turn boundaries) and is never rendered.
+	CategoryTurn = "turn"
+)
+
+// Event is a typed codex/event beyond agent messages and reasoning.
+type Event interface {
+	Category() string
+}
+
+// ExecBegin: exec_command_begin.
+type ExecBegin struct {
+	CallID  string
+	Command string
+	Cwd     string
+}
+
+// ExecEnd: exec_command_end. Output is the combined stdout/stderr.
+type ExecEnd struct {
+	CallID   string
+	ExitCode int
+	Output   string
+	Duration time.Duration
+}
+
+// FileChange is one entry of a patch.
+type FileChange struct {
+	Path string
+	// Kind is add, delete or update
+	Kind     string
+	MovePath string
+	Added    int
+	Removed  int
+}
+
+// PatchBegin: patch_apply_begin.
+type PatchBegin struct {
+	CallID       string
+	AutoApproved bool
+	Files        []FileChange
+}
+
+// PatchEnd: patch_apply_end.
+type PatchEnd struct {
+	CallID  string
+	Success bool
+	Output  string
+}
+
+// MCPToolBegin: mcp_tool_call_begin.
+type MCPToolBegin struct {
+	CallID    string
+	Server    string
+	Tool      string
+	Arguments string
+}
+
+// MCPToolEnd: mcp_tool_call_end. Error is empty on success.
+type MCPToolEnd struct {
+	CallID   string
+	Server   string
+	Tool     string
+	Duration time.Duration
+	Error    string
+}
+
+// WebSearch: web_search_end.
+type WebSearch struct {
+	CallID string
+	Query  string
+}
+
+// TurnDiff: turn_diff, the unified diff of everything changed in the turn so far.
+type TurnDiff struct {
+	Diff string
+}
+
+// PlanStep is one checklist item of a plan update.
+type PlanStep struct {
+	Step string
+	// Status is pending, in_progress or completed
+	Status string
+}
+
+// PlanUpdate: plan_update.
+type PlanUpdate struct {
+	Explanation string
+	Steps       []PlanStep
+}
+
+// TurnComplete marks the end of a turn (task_complete or turn_aborted).
+type TurnComplete struct {
+	Aborted bool
+}
+
+func (ExecBegin) Category() string    { return CategoryExec }
+func (ExecEnd) Category() string      { return CategoryExec }
+func (PatchBegin) Category() string   { return CategoryPatch }
+func (PatchEnd) Category() string     { return CategoryPatch }
+func (MCPToolBegin) Category() string { return CategoryMCP }
+func (MCPToolEnd) Category() string   { return CategoryMCP }
+func (WebSearch) Category() string    { return CategoryWebSearch }
+func (TurnDiff) Category() string     { return CategoryDiff }
+func (PlanUpdate) Category() string   { return CategoryPlan }
+func (TurnComplete) Category() string { return CategoryTurn }
+
+// WithEventHandler registers the callback for typed tool/plan/diff events.
+func (m *MCPBridge) WithEventHandler(fn func(channelID string, requestID int64, ev Event)) *MCPBridge {
+	m.onEvent = fn
+	return m
+}
+
+// parseEvent converts a codex/event msg object into a typed Event.
+func parseEvent(msg map[string]any) (Event, bool) {
+	typ, _ := msg["type"].(string)
+	str := func(k string) string { s, _ := msg[k].(string); return s }
+	switch typ {
+	case "exec_command_begin":
+		return ExecBegin{CallID: str("call_id"), Command: joinCommand(msg["command"]), Cwd: str("cwd")}, true
+	case "exec_command_end":
+		out := str("aggregated_output")
+		if out == "" {
+			out = strings.TrimRight(str("stdout"), "\n")
+			if e := strings.TrimRight(str("stderr"), "\n"); e != "" {
+				if out != "" {
+					out += "\n"
+				}
+				out += e
+			}
+		}
+		code, _ := msg["exit_code"].(float64)
+		return ExecEnd{CallID: str("call_id"), ExitCode: int(code), Output: out, Duration: parseDuration(msg["duration"])}, true
+	case "patch_apply_begin":
+		auto, _ := msg["auto_approved"].(bool)
+		changes, _ := msg["changes"].(map[string]any)
+		return PatchBegin{CallID: str("call_id"), AutoApproved: auto, Files: parseFileChanges(changes)}, true
+	case "patch_apply_end":
+		ok, _ := msg["success"].(bool)
+		out := strings.TrimSpace(str("stdout") + "\n" + str("stderr"))
+		return PatchEnd{CallID: str("call_id"), Success: ok, Output: out}, true
+	case "mcp_tool_call_begin":
+		inv, _ := msg["invocation"].(map[string]any)
+		server, _ := inv["server"].(string)
+		tool, _ := inv["tool"].(string)
+		var args string
+		if a, ok := inv["arguments"]; ok && a != nil {
+			b, _ := json.Marshal(a)
+			args = string(b)
+		}
+		return MCPToolBegin{CallID: str("call_id"), Server: server, Tool: tool, Arguments: args}, true
+	case "mcp_tool_call_end":
+		inv, _ := msg["invocation"].(map[string]any)
+		server, _ := inv["server"].(string)
+		tool, _ := inv["tool"].(string)
+		ev := MCPToolEnd{CallID: str("call_id"), Server: server, Tool: tool, Duration: parseDuration(msg["duration"])}
+		// result is a Rust Result: {"Ok": {...}} or {"Err": "..."}
+		if res, ok := msg["result"].(map[string]any); ok {
+			if e, ok := res["Err"]; ok {
+				ev.Error = fmt.Sprintf("%v", e)
+			} else if okv, ok := res["Ok"].(map[string]any); ok && okv["isError"] == true {
+				ev.Error = extractTextFromResult(okv)
+				if ev.Error == "" {
+					ev.Error = "error"
+				}
+			}
+		}
+		return ev, true
+	case "web_search_end":
+		return WebSearch{CallID: str("call_id"), Query: str("query")}, true
+	case "turn_diff":
+		return TurnDiff{Diff: str("unified_diff")}, true
+	case "plan_update":
+		ev := PlanUpdate{Explanation: str("explanation")}
+		items, _ := msg["plan"].([]any)
+		for _, it := range items {
+			im, _ := it.(map[string]any)
+			step, _ := im["step"].(string)
+			status, _ := im["status"].(string)
+			ev.Steps = append(ev.Steps, PlanStep{Step: step, Status: status})
+		}
+		return ev, true
+	}
+	return nil, false
+}
+
+func parseFileChanges(changes map[string]any) []FileChange {
+	out := make([]FileChange, 0, len(changes))
+	for path, v := range changes {
+		c, _ := v.(map[string]any)
+		fc := FileChange{Path: path}
+		switch {
+		case c["add"] != nil:
+			fc.Kind = "add"
+			add, _ := c["add"].(map[string]any)
+			content, _ := add["content"].(string)
+			fc.Added = countLines(content)
+		case c["delete"] != nil:
+			fc.Kind = "delete"
+			del, _ := c["delete"].(map[string]any)
+			content, _ := del["content"].(string)
+			fc.Removed = countLines(content)
+		case c["update"] != nil:
+			fc.Kind = "update"
+			upd, _ := c["update"].(map[string]any)
+			fc.MovePath, _ = upd["move_path"].(string)
+			diff, _ := upd["unified_diff"].(string)
+			fc.Added, fc.Removed = diffStat(diff)
+		}
+		out = append(out, fc)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+func countLines(s string) int {
+	if s == "" {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(s, "\n"), "\n") + 1
+}
+
+// diffStat counts added/removed lines of a unified diff.
+func diffStat(diff string) (added, removed int) {
+	var h DiffHunk
+	for _, l := range strings.Split(diff, "\n") {
+		if !h.Inside() {
+			h.Start(l)
+			continue
+		}
+		switch h.Line(l) {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// DiffHunk follows the body of a unified diff hunk using the line counts of
+// its "@@ -a,b +c,d @@" header, so that content lines such as "-- comment"
+// (shown as "--- comment") are not taken for file headers.
+type DiffHunk struct {
+	old, new int
+}
+
+// Start begins a hunk if l is a hunk header.
+func (h *DiffHunk) Start(l string) bool {
+	rest, ok := strings.CutPrefix(l, "@@ -")
+	if !ok {
+		return false
+	}
+	oldRange, rest, ok := strings.Cut(rest, " +")
+	if !ok {
+		return false
+	}
+	newRange, _, ok := strings.Cut(rest, " @@")
+	if !ok {
+		return false
+	}
+	o, ok1 := hunkCount(oldRange)
+	n, ok2 := hunkCount(newRange)
+	if !ok1 || !ok2 {
+		return false
+	}
+	h.old, h.new = o, n
+	return true
+}
+
+// Inside reports whether the next line still belongs to the hunk.
+func (h *DiffHunk) Inside() bool { return h.old > 0 || h.new > 0 }
+
+// Line consumes a line of the hunk and reports its kind: '+', '-', ' ' for
+// context, or '\\' for "\ No newline at end of file".
+func (h *DiffHunk) Line(l string) byte {
+	switch {
+	case strings.HasPrefix(l, "+"):
+		h.new--
+		return '+'
+	case strings.HasPrefix(l, "-"):
+		h.old--
+		return '-'
+	case strings.HasPrefix(l, "\\"):
+		return '\\'
+	}
+	// context; some tools drop the leading space of empty lines
+	h.old--
+	h.new--
+	return ' '
+}
+
+// hunkCount parses "start[,count]" of a hunk header; count defaults to 1.
+func hunkCount(r string) (int, bool) {
+	start, count, found := strings.Cut(r, ",")
+	if _, err := strconv.Atoi(start); err != nil {
+		return 0, false
+	}
+	if !found {
+		return 1, true
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseDuration accepts {secs,nanos} (serde Duration), "1.2s" strings or
+// numbers of milliseconds.
+func parseDuration(v any) time.Duration {
+	switch t := v.(type) {
+	case map[string]any:
+		secs, _ := t["secs"].(float64)
+		nanos, _ := t["nanos"].(float64)
+		return time.Duration(secs)*time.Second + time.Duration(nanos)
+	case string:
+		d, _ := time.ParseDuration(t)
+		return d
+	case float64:
+		return time.Duration(t) * time.Millisecond
+	}
+	return 0
+}
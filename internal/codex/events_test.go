@@ -0,0 +1,52 @@
+package codex
+
+import "testing"
+
+func TestDiffStat(t *testing.T) {
+	tests := []struct {
+		name           string
+		diff           string
+		added, removed int
+	}{
+		{"empty", "", 0, 0},
+		{"headers only", "--- a/x\n+++ b/x\n", 0, 0},
+		{"update", "--- a/x\n+++ b/x\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n", 1, 1},
+		{"content without headers", "@@ -1 +1,2 @@\n-a\n+b\n+c\n", 2, 1},
+		{"removed line starting with --", "@@ -1,2 +1 @@\n--- comment\n keep\n", 0, 1},
+		{"added line starting with ++", "@@ -0,0 +1 @@\n+++ i;\n", 1, 0},
+		{"two hunks", "@@ -1 +1 @@\n-a\n+b\n@@ -9,0 +10,2 @@\n+c\n+d\n", 3, 1},
+		{"no newline marker", "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+b\n", 1, 1},
+		{"lines after the hunk ignored", "@@ -1 +1 @@\n-a\n+b\n-stray\n", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffStat(tt.diff)
+			if added != tt.added || removed != tt.removed {
+				t.Errorf("diffStat = +%d -%d, want +%d -%d", added, removed, tt.added, tt.removed)
+			}
+		})
+	}
+}
+
+func TestDiffHunkStart(t *testing.T) {
+	tests := []struct {
+		line     string
+		ok       bool
+		old, new int
+	}{
+		{"@@ -1,3 +1,4 @@", true, 3, 4},
+		{"@@ -1 +1 @@ func main() {", true, 1, 1},
+		{"@@ -0,0 +1,2 @@", true, 0, 2},
+		{"@@ -5,2 +4,0 @@", true, 2, 0},
+		{"@@ -a,1 +1 @@", false, 0, 0},
+		{"@@ -1,-1 +1 @@", false, 0, 0},
+		{"@@@ -1 -1 +1 @@@", false, 0, 0},
+		{"--- a/x", false, 0, 0},
+	}
+	for _, tt := range tests {
+		var h DiffHunk
+		if ok := h.Start(tt.line); ok != tt.ok || h.old != tt.old || h.new != tt.new {
+			t.Errorf("Start(%q) = %v (-%d +%d), want %v (-%d +%d)", tt.line, ok, h.old, h.new, tt.ok, tt.old, tt.new)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package codex
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -9,7 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,64 +16,256 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
 )
 
 // InteractiveTailBridge runs `codex` interactively and tails .codex/sessions/*.jsonl for outputs.
+// It is the backend for Codex builds without `codex mcp`: the session file's
+// events drive the same stream and event callbacks as MCPBridge, but there are
+// no approvals or cancel.
 type InteractiveTailBridge struct {
 	conf config.Codex
 	mu   sync.Mutex
 	// channelID -> session
 	m map[string]*itSession
+
+	queues   turnQueues
+	handlers Handlers
+	// stream ids for the bot; a range of their own so they never collide
+	// with MCP request ids
+	reqID int64
+	// budgets and usage counters, shared with the MCP backend (set by NewRouter)
+	usage accounting
+}
+
+// accounting checks token budgets and records finished turns. MCPBridge keeps
+// the counters for every backend.
+type accounting interface {
+	checkQuota(ch config.Channel, userID string) error
+	recordUsage(a *turnAccount, conversationID string)
 }
 
 func NewInteractiveTailBridge(conf config.Codex) *InteractiveTailBridge {
-	return &InteractiveTailBridge{conf: conf, m: map[string]*itSession{}}
+	return &InteractiveTailBridge{conf: conf, m: map[string]*itSession{}, reqID: 1 << 40}
+}
+
+// SetHandlers registers the callbacks. Approval and cancel are not available
+// in interactive mode.
+func (b *InteractiveTailBridge) SetHandlers(h Handlers) {
+	b.mu.Lock()
+	b.handlers = h
+	b.mu.Unlock()
+}
+
+// Reload swaps in new [codex] settings. Running sessions keep theirs.
+func (b *InteractiveTailBridge) Reload(conf config.Codex) {
+	b.mu.Lock()
+	b.conf = conf
+	b.mu.Unlock()
+}
+
+func (b *InteractiveTailBridge) codexConf() config.Codex {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conf
+}
+
+// ChatMulti runs one turn after the channel's earlier prompts, within the
+// same token budgets as the MCP backend.
+func (b *InteractiveTailBridge) ChatMulti(ctx context.Context, ch config.Channel, prompt string) ([]string, error) {
+	release, err := b.queues.acquire(ctx, ch.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	userID := UserIDFrom(ctx)
+	if b.usage != nil {
+		if err := b.usage.checkQuota(ch, userID); err != nil {
+			return nil, err
+		}
+	}
+	acct := &turnAccount{channelID: ch.ChannelID, budgetChannel: budgetChannel(ch), userID: userID, started: time.Now()}
+	if b.usage != nil {
+		// cancelled and failed turns still spent tokens
+		defer b.usage.recordUsage(acct, "")
+	}
+	s, err := b.run(ctx, ch, prompt, acct)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	return []string{s}, nil
+}
+
+// Reset stops the channel's Codex session; the next prompt starts a new one.
+func (b *InteractiveTailBridge) Reset(channelID string) error {
+	release, ok := b.queues.tryAcquire(channelID)
+	if !ok {
+		return ErrBusy
+	}
+	defer release()
+	b.mu.Lock()
+	s := b.m[channelID]
+	delete(b.m, channelID)
+	b.mu.Unlock()
+	if s != nil {
+		s.stop()
+	}
+	return nil
+}
+
+// Cancel is not supported: the interactive CLI has no way to abort a turn.
+func (b *InteractiveTailBridge) Cancel(channelID string) bool { return false }
+
+func (b *InteractiveTailBridge) Status(ch config.Channel) Status {
+	st := Status{Backend: config.BackendInteractive, Queued: b.queues.queued(ch.ChannelID)}
+	b.mu.Lock()
+	s := b.m[ch.ChannelID]
+	b.mu.Unlock()
+	if s != nil {
+		select {
+		case <-s.done:
+		default:
+			st.ProcessRunning = true
+		}
+	}
+	return st
+}
+
+// Close stops every session.
+func (b *InteractiveTailBridge) Close() {
+	b.mu.Lock()
+	sessions := b.m
+	b.m = map[string]*itSession{}
+	b.mu.Unlock()
+	for _, s := range sessions {
+		s.stop()
+	}
 }
 
 func (b *InteractiveTailBridge) Chat(ctx context.Context, ch config.Channel, prompt string) (string, error) {
-	s, err := b.ensure(ctx, ch)
+	msgs, err := b.ChatMulti(ctx, ch, prompt)
 	if err != nil {
 		return "", err
 	}
+	return strings.Join(msgs, "\n\n"), nil
+}
+
+// run sends prompt to the channel's session and follows the session file
+// until the turn ends; token counts go to acct.
+func (b *InteractiveTailBridge) run(ctx context.Context, ch config.Channel, prompt string, acct *turnAccount) (string, error) {
+	s, err := b.ensure(ch)
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	h := b.handlers
+	b.mu.Unlock()
+	// drop leftovers from an earlier turn
+	for drained := false; !drained; {
+		select {
+		case <-s.out:
+		default:
+			drained = true
+		}
+	}
+	reqID := atomic.AddInt64(&b.reqID, 1)
+	channelID := ch.ChannelID
 	// Send prompt
 	if _, err := io.WriteString(s.stdin, strings.TrimSpace(prompt)+"\n"); err != nil {
 		return "", err
 	}
-	// Collect agent message from tail until idle or timeout
-	to := b.conf.TimeoutSeconds
+	to := b.codexConf().TimeoutSeconds
 	if to <= 0 {
 		to = 180
 	}
-	idle := time.NewTimer(1200 * time.Millisecond)
-	defer idle.Stop()
 	deadline := time.NewTimer(time.Duration(to) * time.Second)
 	defer deadline.Stop()
-	var last string
+	// the turn ends with task_complete / turn_aborted in the session file
+	var final, reasoning string
+	// whether final has been handed to Done already
+	delivered := false
+	defer func() {
+		if h.ReasoningEnd != nil {
+			h.ReasoningEnd(channelID)
+		}
+	}()
 	for {
+		var ev tailEvent
 		select {
 		case <-ctx.Done():
-			if last == "" {
-				return "", ctx.Err()
+			// runChat expects the stream to be finalized on ErrCancelled
+			if h.Cancelled != nil {
+				h.Cancelled(channelID, reqID)
 			}
-			return last, nil
+			return "", ErrCancelled
 		case <-deadline.C:
-			if last == "" {
-				return "", errors.New("interactive tail timeout")
+			if delivered {
+				// the reply is out; only task_complete is missing
+				h.Done(channelID, reqID, "")
+				return "", nil
+			}
+			return "", errors.New("interactive tail timeout")
+		case <-s.done:
+			return "", errors.New("codex exited")
+		case ev = <-s.out:
+		}
+		switch ev.Type {
+		case "agent_reasoning_delta":
+			reasoning += ev.Text
+			if h.Reasoning != nil {
+				h.Reasoning(channelID, truncate(reasoning, 120))
+			}
+		case "agent_reasoning":
+			reasoning = ""
+			if h.Reasoning != nil && ev.Text != "" {
+				h.Reasoning(channelID, truncate(ev.Text, 120))
+			}
+		case "agent_message_delta":
+			if h.Delta != nil {
+				h.Delta(channelID, reqID, ev.Text)
+			}
+		case "agent_message":
+			final = ev.Text
+			if h.Done != nil {
+				h.Done(channelID, reqID, final)
+				delivered = true
+			}
+		case "token_count":
+			acct.add(ev.Usage)
+			countTokens(budgetChannel(ch), ev.Usage)
+		default:
+			tc, done := ev.Event.(TurnComplete)
+			if !done {
+				if ev.Event != nil && h.Event != nil {
+					h.Event(channelID, reqID, ev.Event)
+				}
+				continue
+			}
+			if final == "" {
+				// task_complete carries the last message when none was logged
+				final = ev.Text
 			}
-			return last, nil
-		case m := <-s.out:
-			if m != "" {
-				last = m
+			if h.Done == nil {
+				return final, nil
 			}
-			idle.Reset(1200 * time.Millisecond)
-		case <-idle.C:
-			if last != "" {
-				return last, nil
+			if delivered {
+				// closes a stream left open by later deltas, if any
+				h.Done(channelID, reqID, "")
+			} else {
+				h.Done(channelID, reqID, final)
 			}
-			idle.Reset(1200 * time.Millisecond)
+			if h.Event != nil {
+				h.Event(channelID, reqID, tc)
+			}
+			// the reply went through the stream pipeline
+			return "", nil
 		}
 	}
 }
@@ -82,7 +273,16 @@ func (b *InteractiveTailBridge) Chat(ctx context.Context, ch config.Channel, pro
 type itSession struct {
 	cmd   *exec.Cmd
 	stdin io.WriteCloser
-	out   chan string
+	out   chan tailEvent
+	// closed when the process exits
+	done chan struct{}
+}
+
+func (s *itSession) stop() {
+	_ = s.stdin.Close()
+	if s.cmd.Process != nil {
+		_ = s.cmd.Process.Kill()
+	}
 }
 
 type limitedBuffer struct {
@@ -107,7 +307,9 @@ func (b *limitedBuffer) Write(p []byte) (int, error) {
 
 func (b *limitedBuffer) String() string { return b.buf.String() }
 
-func (b *InteractiveTailBridge) ensure(ctx context.Context, ch config.Channel) (*itSession, error) {
+// ensure returns the channel's session, starting Codex on first use. The
+// process outlives the request that started it.
+func (b *InteractiveTailBridge) ensure(ch config.Channel) (*itSession, error) {
 	b.mu.Lock()
 	s := b.m[ch.ChannelID]
 	b.mu.Unlock()
@@ -120,18 +322,18 @@ func (b *InteractiveTailBridge) ensure(ctx context.Context, ch config.Channel) (
 		return nil, rerr
 	}
 	before := snapshotSessionFiles(root)
-	// Build command line
-	// default: `codex -a never --sandbox workspace-write`
+	// Build command line; without one, the resolved conversation settings
+	// become flags (approvals cannot be answered here, so always never)
 	var cmd *exec.Cmd
 	line := strings.TrimSpace(ch.Command)
 	if line != "" {
 		if runtime.GOOS == "windows" {
-			cmd = exec.CommandContext(ctx, "powershell", "-NoLogo", "-Command", line)
+			cmd = exec.Command("powershell", "-NoLogo", "-Command", line)
 		} else {
-			cmd = exec.CommandContext(ctx, "bash", "-lc", line)
+			cmd = exec.Command("bash", "-lc", line)
 		}
 	} else {
-		cmd = exec.CommandContext(ctx, "codex", "-a", "never", "--sandbox", "workspace-write")
+		cmd = exec.Command("codex", interactiveArgs(b.codexConf().Resolve(ch))...)
 	}
 	if strings.TrimSpace(ch.Workdir) != "" {
 		cmd.Dir = ch.Workdir
@@ -170,31 +372,70 @@ func (b *InteractiveTailBridge) ensure(ctx context.Context, ch config.Channel) (
 	lbErr := newLimitedBuffer(64 * 1024)
 	go func(r io.Reader) { _, _ = io.Copy(lbOut, r) }(stdout)
 	go func(r io.Reader) { _, _ = io.Copy(lbErr, r) }(stderr)
+	ns := &itSession{cmd: cmd, stdin: stdin, out: make(chan tailEvent, 64), done: make(chan struct{})}
 	go func() {
 		_ = cmd.Wait()
 		if time.Since(start) < time.Second {
-			log.Printf("codex exited early (%v). stdout:\n%s\nstderr:\n%s", time.Since(start), lbOut.String(), lbErr.String())
+			slog.Warn("interactive: codex exited early", logging.KeyChannel, ch.ChannelID, "after", time.Since(start), "stdout", lbOut.String(), "stderr", lbErr.String())
+		}
+		close(ns.done)
+		b.mu.Lock()
+		if b.m[ch.ChannelID] == ns {
+			delete(b.m, ch.ChannelID)
+		}
+		last := len(b.m) == 0
+		down := b.handlers.Down
+		b.mu.Unlock()
+		if last && down != nil {
+			down()
 		}
 	}()
 
 	// Find session file by diffing with baseline
 	sessPath, err := waitNewSessionFileFromSnapshot(root, before, start, 20*time.Second)
 	if err != nil {
-		_ = cmd.Process.Kill()
+		ns.stop()
 		return nil, err
 	}
-	out := make(chan string, 8)
-	go tailJSONL(sessPath, out)
+	go tailJSONL(sessPath, ns.out, ns.done)
 
-	ns := &itSession{cmd: cmd, stdin: stdin, out: out}
 	b.mu.Lock()
 	b.m[ch.ChannelID] = ns
+	up := b.handlers.Up
 	b.mu.Unlock()
+	if up != nil {
+		up()
+	}
 	return ns, nil
 }
 
+// interactiveArgs are the `codex` flags for a resolved channel.
+func interactiveArgs(ch config.Channel) []string {
+	args := []string{"-a", "never", "--sandbox", ch.Sandbox}
+	if ch.Model != "" {
+		args = append(args, "-m", ch.Model)
+	}
+	if ch.Profile != "" {
+		args = append(args, "-p", ch.Profile)
+	}
+	keys := make([]string, 0, len(ch.CodexConfig))
+	for k := range ch.CodexConfig {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// -c takes TOML values; JSON scalars and arrays read the same
+		v, err := json.Marshal(ch.CodexConfig[k])
+		if err != nil {
+			continue
+		}
+		args = append(args, "-c", k+"="+string(v))
+	}
+	return args
+}
+
 func (b *InteractiveTailBridge) waitRoot() (string, error) {
-	if r := strings.TrimSpace(b.conf.SessionRoot); r != "" {
+	if r := strings.TrimSpace(b.codexConf().SessionRoot); r != "" {
 		return filepath.Clean(r), nil
 	}
 	home, err := os.UserHomeDir()
@@ -306,66 +547,3 @@ func waitNewSessionFileFromSnapshot(root string, before sessionSnapshot, since t
 	}
 	return "", fmt.Errorf("session file not found in %q", root)
 }
-
-func tailJSONL(path string, out chan<- string) {
-	// open and seek to end
-	f, err := os.Open(path)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-	// start from end to avoid flooding old logs
-	if _, err := f.Seek(0, io.SeekEnd); err != nil { /* ignore */
-	}
-	r := bufio.NewReader(f)
-	for {
-		line, err := r.ReadString('\n')
-		if errors.Is(err, io.EOF) {
-			time.Sleep(300 * time.Millisecond)
-			continue
-		}
-		if err != nil {
-			return
-		}
-		if m := extractAgentMessageFromAnyJSON(line); m != "" {
-			out <- m
-		}
-	}
-}
-
-func extractAgentMessageFromAnyJSON(line string) string {
-	s := strings.TrimSpace(line)
-	if s == "" {
-		return ""
-	}
-	var v map[string]any
-	if json.Unmarshal([]byte(s), &v) != nil {
-		return ""
-	}
-	// Possible shapes: {msg:{type,message}}, {type,message}, {messages:[...]} etc.
-	if msg, ok := v["msg"].(map[string]any); ok {
-		if t, _ := msg["type"].(string); t == "agent_message" {
-			if m, _ := msg["message"].(string); m != "" {
-				return strings.TrimSpace(m)
-			}
-		}
-	}
-	if t, _ := v["type"].(string); t == "agent_message" {
-		if m, _ := v["message"].(string); m != "" {
-			return strings.TrimSpace(m)
-		}
-	}
-	// messages array fallback
-	if arr, ok := v["messages"].([]any); ok {
-		for i := len(arr) - 1; i >= 0; i-- {
-			if m, ok := arr[i].(map[string]any); ok {
-				if t, _ := m["type"].(string); t == "agent_message" {
-					if s, _ := m["message"].(string); s != "" {
-						return strings.TrimSpace(s)
-					}
-				}
-			}
-		}
-	}
-	return ""
-}
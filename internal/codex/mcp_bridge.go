@@ -1,24 +1,19 @@
 package codex
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"runtime"
-	"sort"
+	"log/slog"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/aoisensi/discodex/internal/metrics"
+	"github.com/aoisensi/discodex/internal/store"
 )
 
 // context keys for passing metadata (e.g., user)
@@ -26,6 +21,10 @@ type ctxKey int
 
 const (
 	ctxKeyUserTag ctxKey = iota + 1
+	ctxKeyUserID
+	ctxKeyAccount
+	ctxKeyQueueNotify
+	ctxKeyImages
 )
 
 // WithUserTag attaches a user tag (e.g., Discord display name) to context.
@@ -33,44 +32,62 @@ func WithUserTag(ctx context.Context, tag string) context.Context {
 	return context.WithValue(ctx, ctxKeyUserTag, tag)
 }
 
+// WithImages attaches local image files that the turn sends to Codex as image
+// inputs along with the prompt.
+func WithImages(ctx context.Context, paths []string) context.Context {
+	return context.WithValue(ctx, ctxKeyImages, paths)
+}
+
+// ErrCancelled is returned by ChatMulti when the turn was cancelled via Cancel.
+var ErrCancelled = errors.New("codex: turn cancelled")
+
+// ErrBusy is returned by Reset while a turn of the conversation is running or
+// queued; resetting then would pull the conversation from under it.
+var ErrBusy = errors.New("codex: a turn is running or queued")
+
 type MCPBridge struct {
-	conf  config.Codex
-	debug bool
-
-	mu      sync.Mutex
-	cmd     *exec.Cmd
-	stdin   io.WriteCloser
-	scan    *bufio.Scanner
-	ready   bool
-	reqID   int64
-	pending map[int64]chan json.RawMessage
-
-	// channelID -> conversationId
-	convo sync.Map
+	// conf and quota are swapped by Reload; read them via codexConf/quotaConf
+	confMu sync.RWMutex
+	conf   config.Codex
 
-	// closed when the running process exits
-	deadCh chan struct{}
+	mu sync.Mutex
+	// process key (command, workdir, env) -> supervised child
+	procs map[string]*mcpProc
+	reqID int64
 
-	// request id -> owner channelID
-	owners map[int64]string
+	// channelID -> convoState
+	convo sync.Map
+	// persistence for conversations (nil: memory only)
+	store store.Store
+	// tools/call request id -> rollout path from session_configured
+	rollouts map[int64]string
+	// process generation counter (bridge-wide)
+	genSeq int64
 
 	// live reasoning buffer per request id
 	reasonBuf map[int64]string
 
+	// conversation key -> FIFO of turns (one runs at a time)
+	queues turnQueues
+
+	// token budgets and the usage of the last turn per channel
+	quota    config.Quota
+	lastTurn map[string]store.Usage
+
 	// callbacks
 	onReasoning    func(channelID string, text string)
 	onReasoningEnd func(channelID string)
 	onAgentDelta   func(channelID string, requestID int64, delta string)
 	onAgentDone    func(channelID string, requestID int64, final string)
+	onApproval     func(ctx context.Context, req ApprovalRequest) ApprovalDecision
+	onCancelled    func(channelID string, requestID int64)
+	onEvent        func(channelID string, requestID int64, ev Event)
 
 	// lifecycle callbacks
-	onUp   func()
-	onDown func()
-
-	// idle shutdown
-	idleSeconds int
-	idleTimer   *time.Timer
-	lastActive  time.Time
+	onUp     func()
+	onDown   func()
+	onGiveUp func(channelIDs []string, err error)
+	onExit   func(err *ExitError)
 
 	// suppression of procedural agent messages (e.g., "read AGENTS.md")
 	suppress map[int64]bool
@@ -78,14 +95,7 @@ type MCPBridge struct {
 }
 
 func NewMCPBridge(conf config.Codex) *MCPBridge {
-	dbg := conf.Debug
-	if !dbg {
-		if v, ok := os.LookupEnv("DISCODEX_DEBUG"); ok {
-			dbg = v != "" && v != "0" && strings.ToLower(v) != "false"
-		}
-	}
-	idle := conf.IdleSeconds
-	return &MCPBridge{conf: conf, debug: dbg, pending: map[int64]chan json.RawMessage{}, owners: map[int64]string{}, reasonBuf: map[int64]string{}, idleSeconds: idle, suppress: map[int64]bool{}, msgBuf: map[int64]string{}}
+	return &MCPBridge{conf: conf, procs: map[string]*mcpProc{}, rollouts: map[int64]string{}, reasonBuf: map[int64]string{}, lastTurn: map[string]store.Usage{}, suppress: map[int64]bool{}, msgBuf: map[int64]string{}}
 }
 
 // WithReasoningHandler registers callbacks for reasoning status updates.
@@ -102,181 +112,67 @@ func (m *MCPBridge) WithStreamHandler(onDelta func(channelID string, requestID i
 	return m
 }
 
-// WithStateHandler registers lifecycle callbacks for MCP process up/down.
+// WithCancelHandler registers the callback fired after a turn is cancelled so
+// the partial stream can be finalized.
+func (m *MCPBridge) WithCancelHandler(fn func(channelID string, requestID int64)) *MCPBridge {
+	m.onCancelled = fn
+	return m
+}
+
+// WithStateHandler registers lifecycle callbacks. onUp fires whenever a process
+// comes up; onDown fires once the last running process has exited.
 func (m *MCPBridge) WithStateHandler(onUp func(), onDown func()) *MCPBridge {
 	m.onUp = onUp
 	m.onDown = onDown
 	return m
 }
 
-func (m *MCPBridge) touchActivity() {
-	if m.idleSeconds <= 0 {
-		return
-	}
-	m.mu.Lock()
-	m.lastActive = time.Now()
-	if m.idleTimer != nil {
-		m.idleTimer.Stop()
-	}
-	sec := m.idleSeconds
-	m.idleTimer = time.AfterFunc(time.Duration(sec)*time.Second, func() {
-		m.mu.Lock()
-		if m.idleSeconds <= 0 {
-			m.mu.Unlock()
-			return
-		}
-		last := m.lastActive
-		m.mu.Unlock()
-		if time.Since(last) < time.Duration(sec)*time.Second {
-			return
-		}
-		if m.debug {
-			log.Printf("mcp: idle timeout; closing")
-		}
-		m.Close()
-	})
-	m.mu.Unlock()
+// WithGiveUpHandler registers the callback fired when a process crashed too
+// often and is not restarted until its cooldown has passed. channelIDs are the
+// channels that used it.
+func (m *MCPBridge) WithGiveUpHandler(fn func(channelIDs []string, err error)) *MCPBridge {
+	m.onGiveUp = fn
+	return m
 }
 
-func (m *MCPBridge) ensureStarted(ctx context.Context, ch config.Channel) error {
-	m.mu.Lock()
-	already := m.ready && m.deadCh != nil && !m.isDead()
-	m.mu.Unlock()
-	if already {
-		return nil
-	}
-	// start new process (without holding the lock to avoid deadlocks)
-	return m.start(ctx, ch)
+// WithExitHandler registers the callback fired when a process exits without
+// discodex stopping it; err carries the exit code and the end of its stderr.
+func (m *MCPBridge) WithExitHandler(fn func(err *ExitError)) *MCPBridge {
+	m.onExit = fn
+	return m
 }
 
-func (m *MCPBridge) isDead() bool {
-	select {
-	case <-m.deadCh:
-		return true
-	default:
-		return false
+// proc returns the process for the channel's (command, workdir, env), creating
+// an idle entry on first use.
+func (m *MCPBridge) proc(ch config.Channel) *mcpProc {
+	conf := m.codexConf()
+	key := procKey(conf, ch)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.procs[key]
+	if !ok {
+		p = newMCPProc(m, key, conf, ch)
+		m.procs[key] = p
 	}
+	return p
 }
 
-func (m *MCPBridge) start(ctx context.Context, ch config.Channel) error {
-	// Build command
-	var cmd *exec.Cmd
-	line := strings.TrimSpace(ch.Command)
-	if line == "" {
-		line = strings.TrimSpace(m.conf.Command)
-	}
-	if line == "" {
-		// default to codex mcp: resolve actual binary/script and execute directly
-		if p, e := exec.LookPath("codex"); e == nil {
-			if runtime.GOOS == "windows" {
-				ext := strings.ToLower(filepath.Ext(p))
-				switch ext {
-				case ".ps1":
-					cmd = exec.CommandContext(ctx, "powershell", "-NoLogo", "-ExecutionPolicy", "Bypass", "-File", p, "mcp")
-				default:
-					cmd = exec.CommandContext(ctx, p, "mcp")
-				}
-			} else {
-				cmd = exec.CommandContext(ctx, p, "mcp")
-			}
-		} else {
-			// fallback
-			cmd = exec.CommandContext(ctx, "codex", "mcp")
-		}
-	} else {
-		// run via shell (portable)
-		if runtime.GOOS == "windows" {
-			cmd = exec.CommandContext(ctx, "powershell", "-NoLogo", "-Command", line)
-		} else {
-			cmd = exec.CommandContext(ctx, "bash", "-lc", line)
-		}
-	}
-	if ch.Workdir != "" {
-		cmd.Dir = ch.Workdir
+// procDown is called by a process after it exited.
+func (m *MCPBridge) procDown() {
+	m.mu.Lock()
+	procs := make([]*mcpProc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
 	}
-	if len(ch.Env) > 0 {
-		env := []string{}
-		env = append(env, cmd.Env...)
-		keys := make([]string, 0, len(ch.Env))
-		for k := range ch.Env {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			env = append(env, fmt.Sprintf("%s=%s", k, ch.Env[k]))
+	m.mu.Unlock()
+	for _, p := range procs {
+		if p.alive() {
+			return
 		}
-		cmd.Env = env
-	}
-	// OS-specific process attributes (e.g., create new process group on Unix)
-	setProcAttrs(cmd)
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return err
-	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	cmd.Stderr = cmd.Stdout
-	if m.debug {
-		log.Printf("mcp: starting dir=%q", cmd.Dir)
 	}
-	if err := cmd.Start(); err != nil {
-		return err
+	if m.onDown != nil {
+		m.onDown()
 	}
-	// set fields under lock
-	sc := bufio.NewScanner(stdout)
-	buf := make([]byte, 64*1024)
-	sc.Buffer(buf, 1024*1024)
-	dead := make(chan struct{})
-	m.mu.Lock()
-	m.cmd = cmd
-	m.stdin = stdin
-	m.scan = sc
-	m.deadCh = dead
-	m.mu.Unlock()
-	go m.readLoop()
-	go func() {
-		_ = cmd.Wait()
-		m.mu.Lock()
-		m.ready = false
-		close(dead)
-		m.mu.Unlock()
-		if m.onDown != nil {
-			m.onDown()
-		}
-	}()
-
-	// Initialize
-	type initParams struct {
-		ProtocolVersion string            `json:"protocolVersion"`
-		Capabilities    map[string]any    `json:"capabilities"`
-		ClientInfo      map[string]string `json:"clientInfo"`
-	}
-	if m.debug {
-		log.Printf("mcp: send initialize")
-	}
-	// Don't block on initialize; some servers delay or omit the response.
-	ictx, cancel := context.WithTimeout(ctx, 700*time.Millisecond)
-	_, _ = m.request(ictx, "initialize", initParams{
-		ProtocolVersion: "2024-05-31",
-		Capabilities:    map[string]any{},
-		ClientInfo:      map[string]string{"name": "discodex", "version": "0.1.0"},
-	})
-	cancel()
-	if m.debug {
-		log.Printf("mcp: notify initialized")
-	}
-	_ = m.notify("initialized", map[string]any{})
-	m.mu.Lock()
-	m.ready = true
-	m.mu.Unlock()
-	if m.onUp != nil {
-		m.onUp()
-	}
-	// schedule idle shutdown
-	m.touchActivity()
-	return nil
 }
 
 func (m *MCPBridge) Chat(ctx context.Context, ch config.Channel, prompt string) (string, error) {
@@ -292,68 +188,105 @@ func (m *MCPBridge) Chat(ctx context.Context, ch config.Channel, prompt string)
 
 // ChatMulti runs a prompt and returns one Discord message per agent_message.
 func (m *MCPBridge) ChatMulti(ctx context.Context, ch config.Channel, prompt string) ([]string, error) {
-	if err := m.ensureStarted(ctx, ch); err != nil {
+	userID := UserIDFrom(ctx)
+	// turns of one conversation run one at a time, in arrival order
+	release, err := m.queues.acquire(ctx, ch.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	// checked after waiting: the turns ahead may have used up the budget
+	if err := m.checkQuota(ch, userID); err != nil {
 		return nil, err
 	}
-	m.touchActivity()
+	p := m.proc(ch)
+	if err := p.ensureStarted(ctx); err != nil {
+		return nil, err
+	}
+	acct := &turnAccount{channelID: ch.ChannelID, budgetChannel: budgetChannel(ch), userID: userID, started: time.Now()}
+	ctx = context.WithValue(ctx, ctxKeyAccount, acct)
+	var convID string
+	// cancelled and failed turns still spent tokens
+	defer func() { m.recordUsage(acct, convID) }()
+	p.touchActivity()
 	// Decide tool
 	var tool string
-	args := map[string]any{"prompt": prompt}
-	if v := ctx.Value(ctxKeyUserTag); v != nil {
-		args["user"] = fmt.Sprintf("%v", v)
-	}
-	if v, ok := m.convo.Load(ch.ChannelID); ok {
+	var args map[string]any
+	cs, hasConvo := m.conversation(ch.ChannelID)
+	convID = cs.ConversationID
+	ctx = logging.With(ctx, logging.KeyChannel, ch.ChannelID, logging.KeyUser, userID, logging.KeyConversation, convID)
+	// a conversation only lives on the process generation that created it;
+	// anything else (restored from the store, idle-restarted process) needs a resume
+	resuming := hasConvo && cs.gen != p.generation()
+	switch {
+	case hasConvo && !resuming:
 		tool = "codex-reply"
-		args["conversationId"] = v.(string)
-	} else {
+		args = map[string]any{"prompt": prompt, "conversationId": cs.ConversationID}
+	case resuming && cs.RolloutPath != "":
+		// resume the recorded Codex session file in a fresh conversation
 		tool = "codex"
-		// preamble を先頭に差し込む
-		pre := strings.TrimSpace(m.conf.Preamble)
-		if pre != "" {
-			p := strings.TrimSpace(prompt)
-			prompt = pre + "\n\n" + p
-			args["prompt"] = prompt
-		}
-		args["sandbox"] = "workspace-write"
-		args["approval-policy"] = "never"
-		if ch.Workdir != "" {
-			args["cwd"] = ch.Workdir
-		}
-	}
-	type callParams struct {
-		Name      string         `json:"name"`
-		Arguments map[string]any `json:"arguments"`
-	}
-	// Try once; if write error due to closed pipe, restart and retry
-	if m.debug {
-		log.Printf("mcp => tools/call %s", tool)
+		args = m.newConversationArgs(ch, prompt, false)
+		cfg, _ := args["config"].(map[string]any)
+		if cfg == nil {
+			cfg = map[string]any{}
+		}
+		cfg["experimental_resume"] = cs.RolloutPath
+		args["config"] = cfg
+	case resuming:
+		// some Codex builds keep sessions across restarts; try the old id first
+		tool = "codex-reply"
+		args = map[string]any{"prompt": prompt, "conversationId": cs.ConversationID}
+	default:
+		tool = "codex"
+		args = m.newConversationArgs(ch, prompt, true)
+	}
+	turnArgs(ctx, args)
+	obj, res, err := m.callTool(ctx, p, ch, tool, args)
+	// an unknown conversation id or session file comes back as an error
+	// result or a JSON-RPC error; any other error stands
+	var rpcErr *RPCError
+	resumeRejected := (obj["isError"] == true && sessionGone(extractTextFromResult(obj))) ||
+		(errors.As(err, &rpcErr) && rpcErr.Kind() == ErrorKindSessionNotFound)
+	if err != nil && !(resuming && resumeRejected) {
+		return nil, err
 	}
-	res, err := m.requestForChannel(ctx, "tools/call", callParams{Name: tool, Arguments: args}, ch.ChannelID)
-	if err != nil {
-		// attempt restart on write error or closed pipe
-		m.mu.Lock()
-		if m.stdin != nil {
-			_ = m.stdin.Close()
-			m.stdin = nil
-		}
-		if m.cmd != nil {
-			_ = m.cmd.Process.Kill()
-		}
-		m.ready = false
-		m.pending = map[int64]chan json.RawMessage{}
-		m.mu.Unlock()
-		if e := m.ensureStarted(ctx, ch); e == nil {
-			res, err = m.requestForChannel(ctx, "tools/call", callParams{Name: tool, Arguments: args}, ch.ChannelID)
-		}
+	if resuming && resumeRejected {
+		// resume not supported or session gone: start over
+		detail := extractTextFromResult(obj)
+		if err != nil {
+			detail = err.Error()
+		}
+		slog.WarnContext(ctx, "mcp: resume failed; starting a new conversation", "error", truncate(detail, 200))
+		m.forget(ch.ChannelID)
+		hasConvo = false
+		args = m.newConversationArgs(ch, prompt, true)
+		turnArgs(ctx, args)
+		obj, res, err = m.callTool(ctx, p, ch, "codex", args)
 		if err != nil {
 			return nil, err
 		}
 	}
-	m.touchActivity()
-	var obj map[string]any
-	if err := json.Unmarshal(res, &obj); err == nil {
+	p.touchActivity()
+	if obj != nil {
+		now := time.Now()
+		next := cs
+		if !hasConvo {
+			next = convoState{Conversation: store.Conversation{Key: ch.ChannelID, CreatedAt: now}}
+		}
 		if cid, ok := obj["conversationId"].(string); ok && cid != "" {
-			m.convo.Store(ch.ChannelID, cid)
+			if cid != convID {
+				slog.InfoContext(ctx, "mcp: new conversation", logging.KeyRPC, res.id, logging.KeyConversation, cid)
+			}
+			next.ConversationID = cid
+			convID = cid
+		}
+		if path := m.takeRollout(res.id); path != "" {
+			next.RolloutPath = path
+		}
+		if next.ConversationID != "" && obj["isError"] != true {
+			next.gen = p.generation()
+			next.LastActive = now
+			m.saveConversation(next)
 		}
 		// When streaming callbacks are set, avoid returning messages to prevent duplicates.
 		if m.onAgentDelta != nil || m.onAgentDone != nil {
@@ -366,13 +299,97 @@ func (m *MCPBridge) ChatMulti(ctx context.Context, ch config.Channel, prompt str
 			return []string{msg}, nil
 		}
 	}
-	s := strings.TrimSpace(string(res))
+	s := strings.TrimSpace(string(res.raw))
 	if s == "" {
 		return nil, nil
 	}
 	return []string{s}, nil
 }
 
+// newConversationArgs builds the `codex` tool arguments for a new conversation.
+func (m *MCPBridge) newConversationArgs(ch config.Channel, prompt string, withPreamble bool) map[string]any {
+	args := map[string]any{"prompt": prompt}
+	// preamble を先頭に差し込む
+	conf := m.codexConf()
+	pre := strings.TrimSpace(conf.Preamble)
+	if withPreamble && pre != "" {
+		args["prompt"] = pre + "\n\n" + strings.TrimSpace(prompt)
+	}
+	ch = conf.Resolve(ch)
+	args["sandbox"] = ch.Sandbox
+	args["approval-policy"] = ch.ApprovalPolicy
+	if ch.Model != "" {
+		args["model"] = ch.Model
+	}
+	if ch.Profile != "" {
+		args["profile"] = ch.Profile
+	}
+	if ch.BaseInstructions != "" {
+		args["base-instructions"] = ch.BaseInstructions
+	}
+	if len(ch.CodexConfig) > 0 {
+		// copy so the resume path can add keys without touching the config
+		cfg := make(map[string]any, len(ch.CodexConfig)+1)
+		for k, v := range ch.CodexConfig {
+			cfg[k] = v
+		}
+		args["config"] = cfg
+	}
+	if ch.Workdir != "" {
+		args["cwd"] = ch.Workdir
+	}
+	// plan_update is only emitted when the plan tool is available. The tool
+	// changes how Codex works, so it needs an explicit `plan = true`.
+	if ch.Events[CategoryPlan] {
+		args["include-plan-tool"] = true
+	}
+	return args
+}
+
+// turnArgs adds the per-turn arguments carried by ctx: the user tag and the
+// images, as Codex local_image input items.
+func turnArgs(ctx context.Context, args map[string]any) {
+	if v := ctx.Value(ctxKeyUserTag); v != nil {
+		args["user"] = fmt.Sprintf("%v", v)
+	}
+	if paths, _ := ctx.Value(ctxKeyImages).([]string); len(paths) > 0 {
+		items := make([]map[string]any, 0, len(paths))
+		for _, p := range paths {
+			items = append(items, map[string]any{"type": "local_image", "path": p})
+		}
+		args["images"] = items
+	}
+}
+
+// toolResult is a raw tools/call result and the request id that produced it.
+type toolResult struct {
+	id  int64
+	raw json.RawMessage
+}
+
+// callTool sends tools/call. When the child dies mid-call the error is an
+// *ExitError; the supervisor restarts the process, so the call is not
+// retried (the conversation died with it). obj is nil when the result is not
+// a JSON object.
+func (m *MCPBridge) callTool(ctx context.Context, p *mcpProc, ch config.Channel, tool string, args map[string]any) (map[string]any, toolResult, error) {
+	type callParams struct {
+		Name      string         `json:"name"`
+		Arguments map[string]any `json:"arguments"`
+	}
+	slog.DebugContext(ctx, "mcp: tools/call", "tool", tool)
+	params := callParams{Name: tool, Arguments: args}
+	id, raw, err := p.requestForChannelID(ctx, "tools/call", params, ch.ChannelID)
+	if err != nil {
+		return nil, toolResult{}, err
+	}
+	res := toolResult{id: id, raw: raw}
+	var obj map[string]any
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil, res, nil
+	}
+	return obj, res, nil
+}
+
 func extractTextFromResult(obj map[string]any) string {
 	if s, ok := obj["message"].(string); ok {
 		return strings.TrimSpace(s)
@@ -481,14 +498,6 @@ func parseID(s string) (int64, error) {
 	return n, nil
 }
 
-// osDebug reports whether to emit debug logs for MCP I/O.
-func osDebug() bool {
-	if v, ok := os.LookupEnv("DISCODEX_DEBUG"); ok {
-		return v != "" && v != "0" && strings.ToLower(v) != "false"
-	}
-	return false
-}
-
 func truncate(s string, n int) string {
 	if len(s) <= n {
 		return s
@@ -499,119 +508,7 @@ func truncate(s string, n int) string {
 	return s[:n-3] + "..."
 }
 
-func (m *MCPBridge) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
-	id := atomic.AddInt64(&m.reqID, 1)
-	ch := make(chan json.RawMessage, 1)
-	m.mu.Lock()
-	m.pending[id] = ch
-	m.mu.Unlock()
-	req := map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
-	b, _ := json.Marshal(req)
-	if m.debug {
-		log.Printf("mcp => %s %s", method, truncate(string(b), 240))
-	}
-	if _, err := m.stdin.Write(append(b, '\n')); err != nil {
-		return nil, err
-	}
-	to := m.conf.TimeoutSeconds
-	if to <= 0 {
-		to = 180
-	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case res := <-ch:
-		return res, nil
-	case <-time.After(time.Duration(to) * time.Second):
-		return nil, errors.New("mcp request timeout")
-	}
-}
-
-// requestForChannel is like request but records the owner channelID for event correlation.
-func (m *MCPBridge) requestForChannel(ctx context.Context, method string, params any, channelID string) (json.RawMessage, error) {
-	id := atomic.AddInt64(&m.reqID, 1)
-	ch := make(chan json.RawMessage, 1)
-	m.mu.Lock()
-	m.pending[id] = ch
-	if channelID != "" {
-		m.owners[id] = channelID
-	}
-	m.mu.Unlock()
-	req := map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
-	b, _ := json.Marshal(req)
-	if m.debug {
-		log.Printf("mcp => %s %s", method, truncate(string(b), 240))
-	}
-	if _, err := m.stdin.Write(append(b, '\n')); err != nil {
-		return nil, err
-	}
-	to := m.conf.TimeoutSeconds
-	if to <= 0 {
-		to = 180
-	}
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case res := <-ch:
-		return res, nil
-	case <-time.After(time.Duration(to) * time.Second):
-		return nil, errors.New("mcp request timeout")
-	}
-}
-
-func (m *MCPBridge) notify(method string, params any) error {
-	req := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
-	b, _ := json.Marshal(req)
-	if m.debug {
-		log.Printf("mcp => %s %s", method, truncate(string(b), 240))
-	}
-	_, err := m.stdin.Write(append(b, '\n'))
-	return err
-}
-
-func (m *MCPBridge) readLoop() {
-	for m.scan.Scan() {
-		line := strings.TrimSpace(m.scan.Text())
-		if line == "" {
-			continue
-		}
-		var raw map[string]any
-		if json.Unmarshal([]byte(line), &raw) != nil {
-			continue
-		}
-		if m.debug {
-			// 軽量に先頭だけログ
-			log.Printf("mcp <= %s", truncate(line, 240))
-		}
-		// handle notifications (e.g., codex/event)
-		if method, _ := raw["method"].(string); method != "" {
-			m.handleNotify(raw)
-			continue
-		}
-		switch v := raw["id"].(type) {
-		case float64:
-			id := int64(v)
-			if res, ok := raw["result"]; ok {
-				m.deliver(id, res)
-			} else if errObj, ok := raw["error"]; ok {
-				b, _ := json.Marshal(errObj)
-				m.deliver(id, json.RawMessage(b))
-			}
-		case string:
-			// 一部実装は id を文字列で返すことがある
-			if id, err := parseID(v); err == nil {
-				if res, ok := raw["result"]; ok {
-					m.deliver(id, res)
-				} else if errObj, ok := raw["error"]; ok {
-					b, _ := json.Marshal(errObj)
-					m.deliver(id, json.RawMessage(b))
-				}
-			}
-		}
-	}
-}
-
-func (m *MCPBridge) handleNotify(raw map[string]any) {
+func (m *MCPBridge) handleNotify(p *mcpProc, raw map[string]any) {
 	method, _ := raw["method"].(string)
 	if method != "codex/event" {
 		return
@@ -622,15 +519,10 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 	if rv, ok := meta["requestId"]; ok {
 		switch t := rv.(type) {
 		case float64:
-			id := int64(t)
-			m.mu.Lock()
-			owner = m.owners[id]
-			m.mu.Unlock()
+			owner = p.owner(int64(t))
 		case string:
 			if id, err := parseID(t); err == nil {
-				m.mu.Lock()
-				owner = m.owners[id]
-				m.mu.Unlock()
+				owner = p.owner(id)
 			}
 		}
 	}
@@ -640,8 +532,30 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 	}
 	typ, _ := msg["type"].(string)
 	// any event counts as activity
-	m.touchActivity()
+	p.touchActivity()
+	if !strings.HasSuffix(typ, "_delta") && logging.Debug() {
+		id, _ := requestIDOf(meta["requestId"])
+		slog.DebugContext(p.logContext(id), "mcp: codex/event", "type", typ)
+	}
 	switch typ {
+	case "session_configured":
+		// remember the session file so the conversation can be resumed later
+		if path, _ := msg["rollout_path"].(string); path != "" {
+			if id, ok := requestIDOf(meta["requestId"]); ok {
+				m.mu.Lock()
+				m.rollouts[id] = path
+				m.mu.Unlock()
+			}
+		}
+	case "token_count":
+		if u, ok := parseTokenCount(msg); ok {
+			if id, ok := requestIDOf(meta["requestId"]); ok {
+				if a := p.account(id); a != nil {
+					a.add(u)
+					countTokens(a.budgetChannel, u)
+				}
+			}
+		}
 	case "agent_reasoning_delta":
 		delta, _ := msg["delta"].(string)
 		if delta == "" {
@@ -676,6 +590,9 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 		if rv, ok := meta["requestId"].(float64); ok {
 			reqID = int64(rv)
 		}
+		if a := p.account(reqID); a != nil && a.firstDelta() {
+			metrics.FirstDelta.ObserveSince(a.started, a.budgetChannel)
+		}
 		// append buffer and decide suppression
 		m.mu.Lock()
 		buf := m.msgBuf[reqID] + d
@@ -710,8 +627,11 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 		if rv, ok := meta["requestId"].(float64); ok {
 			reqID = int64(rv)
 		}
+		m.mu.Lock()
+		sup := m.suppress[reqID]
+		m.mu.Unlock()
 		// if suppressed and still looks like procedural message, skip output
-		if m.suppress[reqID] && shouldSuppressAgentMsg(final) {
+		if sup && shouldSuppressAgentMsg(final) {
 			// but still clear state below
 		} else {
 			if m.onAgentDone != nil && owner != "" {
@@ -719,7 +639,7 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 			}
 		}
 		fallthrough
-	case "task_complete":
+	case "task_complete", "turn_aborted":
 		// clear buffer and notify end
 		var key int64
 		var reqID int64
@@ -727,11 +647,7 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 			key = int64(rv)
 			reqID = int64(rv)
 		}
-		m.mu.Lock()
-		delete(m.reasonBuf, key)
-		delete(m.msgBuf, key)
-		delete(m.suppress, key)
-		m.mu.Unlock()
+		m.clearRequest(key)
 		// ensure stream termination even if no final agent_message
 		if m.onAgentDone != nil && owner != "" {
 			m.onAgentDone(owner, reqID, "")
@@ -739,6 +655,18 @@ func (m *MCPBridge) handleNotify(raw map[string]any) {
 		if m.onReasoningEnd != nil && owner != "" {
 			m.onReasoningEnd(owner)
 		}
+		if typ != "agent_message" && m.onEvent != nil && owner != "" {
+			m.onEvent(owner, reqID, TurnComplete{Aborted: typ == "turn_aborted"})
+		}
+	default:
+		// tool calls, patches, plan and diff updates
+		if m.onEvent == nil || owner == "" {
+			return
+		}
+		if ev, ok := parseEvent(msg); ok {
+			reqID, _ := requestIDOf(meta["requestId"])
+			m.onEvent(owner, reqID, ev)
+		}
 	}
 }
 
@@ -763,57 +691,122 @@ func shouldSuppressAgentMsg(s string) bool {
 	return false
 }
 
-func (m *MCPBridge) deliver(id int64, v any) {
-	b, _ := json.Marshal(v)
+// Close attempts to gracefully terminate every MCP process.
+func (m *MCPBridge) Close() {
 	m.mu.Lock()
-	ch, ok := m.pending[id]
-	if ok {
-		delete(m.pending, id)
+	procs := make([]*mcpProc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
 	}
 	m.mu.Unlock()
-	if ok {
-		ch <- b
+	var wg sync.WaitGroup
+	for _, p := range procs {
+		wg.Add(1)
+		go func(p *mcpProc) {
+			defer wg.Done()
+			p.close()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// Cancel aborts the in-flight turn(s) of a channel by sending the MCP
+// notifications/cancelled for the tracked request ids. It reports whether
+// anything was running.
+func (m *MCPBridge) Cancel(channelID string) bool {
+	m.mu.Lock()
+	procs := make([]*mcpProc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+	var ids []int64
+	for _, p := range procs {
+		ids = append(ids, p.cancelChannel(channelID)...)
+	}
+	for _, id := range ids {
+		m.clearRequest(id)
+		if m.onCancelled != nil {
+			m.onCancelled(channelID, id)
+		}
 	}
+	if len(ids) > 0 && m.onReasoningEnd != nil {
+		m.onReasoningEnd(channelID)
+	}
+	if len(ids) > 0 {
+		slog.Debug("mcp: cancelled", logging.KeyChannel, channelID, "rpc_ids", ids)
+	}
+	return len(ids) > 0
 }
 
-// Close attempts to gracefully terminate the MCP process.
-func (m *MCPBridge) Close() {
-	// try graceful shutdown via MCP before killing the process
+// clearRequest drops per-request streaming buffers.
+func (m *MCPBridge) clearRequest(id int64) {
 	m.mu.Lock()
-	cmd := m.cmd
-	stdin := m.stdin
+	delete(m.reasonBuf, id)
+	delete(m.msgBuf, id)
+	delete(m.suppress, id)
 	m.mu.Unlock()
+}
 
-	if stdin != nil {
-		// best-effort shutdown sequence
-		ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
-		// ignore errors; the goal is to nudge the server to exit
-		_, _ = m.request(ctx, "shutdown", map[string]any{})
-		cancel()
-		_ = m.notify("exit", map[string]any{})
-		time.Sleep(100 * time.Millisecond)
-		_ = stdin.Close()
-	}
-	if cmd != nil {
-		done := make(chan struct{})
-		go func() { _ = cmd.Wait(); close(done) }()
-		select {
-		case <-done:
-		case <-time.After(1 * time.Second):
-			// try kill process group (Unix), then process
-			killProcessGroup(cmd)
-			_ = cmd.Process.Kill()
-		}
+// Status describes the bridge state seen from one channel.
+type Status struct {
+	// Backend is the backend running the channel (mcp, interactive, stub).
+	Backend        string
+	ConversationID string
+	// ProcessRunning reports whether the channel's Codex process is up.
+	ProcessRunning bool
+	// Pending is the number of in-flight requests on that process.
+	Pending int
+	// Queued is the number of prompts waiting for the channel's running turn.
+	Queued int
+	// Server is the name and version from the initialize response.
+	Server string
+	// Restarts counts automatic restarts after crashes.
+	Restarts int
+	// RetryAt is set while the process is given up on after a crash loop.
+	RetryAt time.Time
+	// Stderr is the end of the process's stderr (the last child, if it exited).
+	Stderr []string
+}
+
+// Status reports the conversation and process state for the channel.
+func (m *MCPBridge) Status(ch config.Channel) Status {
+	st := Status{Backend: config.BackendMCP, Queued: m.queues.queued(ch.ChannelID)}
+	if cs, ok := m.conversation(ch.ChannelID); ok {
+		st.ConversationID = cs.ConversationID
 	}
+	m.mu.Lock()
+	p := m.procs[procKey(m.codexConf(), ch)]
+	m.mu.Unlock()
+	if p != nil {
+		st.ProcessRunning = p.alive()
+		p.mu.Lock()
+		st.Pending = len(p.pending)
+		st.Restarts = p.restarts
+		if name, _ := p.serverInfo["name"].(string); name != "" {
+			st.Server = strings.TrimSpace(fmt.Sprintf("%s %v", name, p.serverInfo["version"]))
+		}
+		if p.gaveUp != nil {
+			st.RetryAt = p.gaveUp.RetryAt
+		}
+		stderr := p.stderr
+		p.mu.Unlock()
+		st.Stderr = stderr.tail(stderrReport)
+	}
+	return st
 }
 
 // Reset clears conversation state for the channel.
-func (m *MCPBridge) Reset(channelID string) {
+func (m *MCPBridge) Reset(channelID string) error {
 	if channelID == "" {
-		return
+		return nil
 	}
-	m.convo.Delete(channelID)
-	if m.debug {
-		log.Printf("mcp: reset conversation for channel %s", channelID)
+	release, ok := m.queues.tryAcquire(channelID)
+	if !ok {
+		return ErrBusy
 	}
+	defer release()
+	m.forget(channelID)
+	slog.Debug("mcp: reset conversation", logging.KeyChannel, channelID)
+	return nil
 }
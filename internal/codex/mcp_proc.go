@@ -0,0 +1,619 @@
+package codex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+)
+
+// mcpProc is one supervised `codex mcp` child. Channels that share the same
+// (command, workdir, env) tuple share a process.
+type mcpProc struct {
+	b   *MCPBridge
+	key string
+	// spawn settings (command/workdir/env) taken from the first channel using this key
+	spawn config.Channel
+
+	// serializes ensureStarted so concurrent callers don't spawn twice
+	startMu sync.Mutex
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	scan    *bufio.Scanner
+	ready   bool
+	pending map[int64]chan rpcReply
+
+	// closed when the running process exits
+	deadCh chan struct{}
+	// the running child's lifecycle flags
+	life *childLife
+	// stderr of the running (or last) child
+	stderr *lineRing
+	// from the initialize response
+	serverInfo   map[string]any
+	capabilities map[string]any
+
+	// restart supervision (see supervisor.go)
+	failures  []time.Time
+	backoff   time.Duration
+	nextStart time.Time
+	restarts  int
+	gaveUp    *CrashLoopError
+	// channels that sent requests to this process, for the give-up notice
+	channels map[string]bool
+
+	// request id -> owner channelID
+	owners map[int64]string
+	// request id -> usage account of the turn (token_count events)
+	accounts map[int64]*turnAccount
+	// request id -> closed by cancel to abort the wait
+	cancels map[int64]chan struct{}
+	// request id -> context carrying the turn's log attributes
+	logCtxs map[int64]context.Context
+
+	// generation of the running child; conversations are bound to it
+	gen int64
+
+	// idle shutdown
+	idleTimer  *time.Timer
+	lastActive time.Time
+
+	// set by Reload when no channel maps to this process any more; it is
+	// closed once the last in-flight request finishes
+	retiring bool
+	// set while close runs; its own shutdown request must not start another
+	closing bool
+}
+
+// procKey identifies the process a channel runs on.
+func procKey(conf config.Codex, ch config.Channel) string {
+	line := strings.TrimSpace(ch.Command)
+	if line == "" {
+		line = strings.TrimSpace(conf.Command)
+	}
+	keys := make([]string, 0, len(ch.Env))
+	for k := range ch.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(line)
+	b.WriteByte(0)
+	b.WriteString(filepath.Clean(ch.Workdir))
+	for _, k := range keys {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(ch.Env[k])
+	}
+	return b.String()
+}
+
+// newMCPProc creates an unstarted process; the command is resolved against
+// conf now so the process keeps matching its key after a reload.
+func newMCPProc(b *MCPBridge, key string, conf config.Codex, ch config.Channel) *mcpProc {
+	line := strings.TrimSpace(ch.Command)
+	if line == "" {
+		line = strings.TrimSpace(conf.Command)
+	}
+	return &mcpProc{b: b, key: key, spawn: config.Channel{Command: line, Workdir: ch.Workdir, Env: ch.Env}, pending: map[int64]chan rpcReply{}, owners: map[int64]string{}, accounts: map[int64]*turnAccount{}, cancels: map[int64]chan struct{}{}, logCtxs: map[int64]context.Context{}, channels: map[string]bool{}}
+}
+
+func (p *mcpProc) touchActivity() {
+	sec := p.b.codexConf().IdleSeconds
+	if sec <= 0 {
+		return
+	}
+	p.mu.Lock()
+	p.lastActive = time.Now()
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	p.idleTimer = time.AfterFunc(time.Duration(sec)*time.Second, func() {
+		p.mu.Lock()
+		last := p.lastActive
+		busy := len(p.pending) > 0
+		p.mu.Unlock()
+		if busy || time.Since(last) < time.Duration(sec)*time.Second {
+			return
+		}
+		slog.Debug("mcp: idle timeout; closing", "workdir", p.spawn.Workdir)
+		p.close()
+	})
+	p.mu.Unlock()
+}
+
+func (p *mcpProc) alive() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ready && p.deadCh != nil && !p.isDead()
+}
+
+// generation returns the id of the current child process.
+func (p *mcpProc) generation() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gen
+}
+
+func (p *mcpProc) isDead() bool {
+	select {
+	case <-p.deadCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// ensureStarted returns once the process is up and initialized. After a crash
+// it waits out the restart backoff; after a crash loop it fails with
+// *CrashLoopError until the cooldown has passed.
+func (p *mcpProc) ensureStarted(ctx context.Context) error {
+	p.startMu.Lock()
+	defer p.startMu.Unlock()
+	if p.alive() {
+		return nil
+	}
+	if err := p.waitRestart(ctx); err != nil {
+		return err
+	}
+	if err := p.start(ctx); err != nil {
+		p.failed(err, 0)
+		return err
+	}
+	return nil
+}
+
+// kill forcibly stops the process; reason ends up in the ExitError of the
+// requests in flight. The supervisor restarts it like any crash.
+func (p *mcpProc) kill(reason string) {
+	p.mu.Lock()
+	if p.life != nil {
+		p.life.reason = reason
+	}
+	if p.stdin != nil {
+		_ = p.stdin.Close()
+		p.stdin = nil
+	}
+	if p.cmd != nil && p.cmd.Process != nil {
+		_ = p.cmd.Process.Kill()
+	}
+	p.ready = false
+	p.mu.Unlock()
+}
+
+func (p *mcpProc) start(ctx context.Context) error {
+	// Build command. The process outlives the request that spawned it, so it
+	// is not bound to ctx; idle shutdown and Close manage its lifetime.
+	var cmd *exec.Cmd
+	ch := p.spawn
+	line := ch.Command
+	if line == "" {
+		// default to codex mcp: resolve actual binary/script and execute directly
+		if path, e := exec.LookPath("codex"); e == nil {
+			if runtime.GOOS == "windows" {
+				ext := strings.ToLower(filepath.Ext(path))
+				switch ext {
+				case ".ps1":
+					cmd = exec.Command("powershell", "-NoLogo", "-ExecutionPolicy", "Bypass", "-File", path, "mcp")
+				default:
+					cmd = exec.Command(path, "mcp")
+				}
+			} else {
+				cmd = exec.Command(path, "mcp")
+			}
+		} else {
+			// fallback
+			cmd = exec.Command("codex", "mcp")
+		}
+	} else {
+		// run via shell (portable)
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("powershell", "-NoLogo", "-Command", line)
+		} else {
+			cmd = exec.Command("bash", "-lc", line)
+		}
+	}
+	if ch.Workdir != "" {
+		cmd.Dir = ch.Workdir
+	}
+	keys := make([]string, 0, len(ch.Env))
+	for k := range ch.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if len(ch.Env) > 0 {
+		env := []string{}
+		env = append(env, cmd.Env...)
+		for _, k := range keys {
+			env = append(env, fmt.Sprintf("%s=%s", k, ch.Env[k]))
+		}
+		cmd.Env = env
+	}
+	// OS-specific process attributes (e.g., create new process group on Unix)
+	setProcAttrs(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	// stderr stays out of the JSON-RPC stream; the last lines go into crash
+	// reports and /codex status
+	stderr := newLineRing(stderrLines)
+	cmd.Stderr = stderr
+	// a grandchild holding stderr open must not keep Wait from returning
+	cmd.WaitDelay = 2 * time.Second
+	// values may be secrets; only the names are logged
+	slog.Debug("mcp: starting", "workdir", cmd.Dir, "env", keys)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// set fields under lock
+	sc := bufio.NewScanner(stdout)
+	buf := make([]byte, 64*1024)
+	sc.Buffer(buf, 1024*1024)
+	dead := make(chan struct{})
+	life := &childLife{started: time.Now()}
+	p.mu.Lock()
+	p.cmd = cmd
+	p.stdin = stdin
+	p.scan = sc
+	p.deadCh = dead
+	p.life = life
+	p.stderr = stderr
+	p.gen = atomic.AddInt64(&p.b.genSeq, 1)
+	p.mu.Unlock()
+	go p.readLoop(sc)
+	go p.wait(cmd, life, dead)
+
+	// Initialize: wait for the response so requests only go to a server
+	// that is ready, and keep what it says about itself
+	type initParams struct {
+		ProtocolVersion string            `json:"protocolVersion"`
+		Capabilities    map[string]any    `json:"capabilities"`
+		ClientInfo      map[string]string `json:"clientInfo"`
+	}
+	ictx, cancel := context.WithTimeout(context.Background(), initTimeout)
+	res, err := p.request(ictx, "initialize", initParams{
+		ProtocolVersion: "2024-05-31",
+		Capabilities:    map[string]any{"elicitation": map[string]any{}},
+		ClientInfo:      map[string]string{"name": "discodex", "version": "0.1.0"},
+	})
+	cancel()
+	if err != nil {
+		// not a crash of a running server: the start itself failed
+		p.mu.Lock()
+		life.stopping = true
+		p.mu.Unlock()
+		p.kill("initialize failed")
+		return fmt.Errorf("codex: MCP initialize failed: %w", err)
+	}
+	var init struct {
+		ServerInfo   map[string]any `json:"serverInfo"`
+		Capabilities map[string]any `json:"capabilities"`
+	}
+	_ = json.Unmarshal(res, &init)
+	slog.Debug("mcp: initialized", "workdir", p.spawn.Workdir, "server", init.ServerInfo, "capabilities", init.Capabilities)
+	_ = p.notify("notifications/initialized", map[string]any{})
+	p.mu.Lock()
+	p.serverInfo = init.ServerInfo
+	p.capabilities = init.Capabilities
+	p.ready = true
+	p.mu.Unlock()
+	if p.b.onUp != nil {
+		p.b.onUp()
+	}
+	go p.pingLoop(life, dead)
+	// schedule idle shutdown
+	p.touchActivity()
+	return nil
+}
+
+func (p *mcpProc) request(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	_, res, err := p.requestForChannelID(ctx, method, params, "")
+	return res, err
+}
+
+// requestForChannelID is like request but records the owner channelID for
+// event correlation, and also returns the request id it used.
+func (p *mcpProc) requestForChannelID(ctx context.Context, method string, params any, channelID string) (int64, json.RawMessage, error) {
+	// ids are allocated bridge-wide so they stay unique across processes
+	id := atomic.AddInt64(&p.b.reqID, 1)
+	if channelID != "" {
+		p.mu.Lock()
+		p.channels[channelID] = true
+		p.mu.Unlock()
+	}
+	ctx = logging.With(ctx, logging.KeyRPC, id)
+	res, err := p.await(ctx, id, method, params, channelID)
+	return id, res, err
+}
+
+func (p *mcpProc) await(ctx context.Context, id int64, method string, params any, channelID string) (json.RawMessage, error) {
+	ch := make(chan rpcReply, 1)
+	abort := make(chan struct{})
+	p.mu.Lock()
+	stdin := p.stdin
+	p.pending[id] = ch
+	if channelID != "" {
+		p.owners[id] = channelID
+		p.cancels[id] = abort
+	}
+	if a := accountFrom(ctx); a != nil {
+		p.accounts[id] = a
+	}
+	p.logCtxs[id] = ctx
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		delete(p.owners, id)
+		delete(p.accounts, id)
+		delete(p.cancels, id)
+		delete(p.logCtxs, id)
+		idle := p.retiring && len(p.pending) == 0
+		if idle {
+			p.retiring = false
+		}
+		p.mu.Unlock()
+		if idle {
+			go p.close()
+		}
+	}()
+	if stdin == nil {
+		return nil, errors.New("mcp process not running")
+	}
+	req := map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+	b, _ := json.Marshal(req)
+	if logging.Debug() {
+		slog.DebugContext(ctx, "mcp =>", "method", method, "line", truncate(string(b), 240))
+	}
+	if _, err := stdin.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	to := p.b.codexConf().TimeoutSeconds
+	if to <= 0 {
+		to = 180
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-abort:
+		return nil, ErrCancelled
+	case res := <-ch:
+		var re *RPCError
+		if errors.As(res.err, &re) {
+			re.Method = method
+		}
+		return res.raw, res.err
+	case <-time.After(time.Duration(to) * time.Second):
+		return nil, errors.New("mcp request timeout")
+	}
+}
+
+func (p *mcpProc) notify(method string, params any) error {
+	p.mu.Lock()
+	stdin := p.stdin
+	p.mu.Unlock()
+	if stdin == nil {
+		return errors.New("mcp process not running")
+	}
+	req := map[string]any{"jsonrpc": "2.0", "method": method, "params": params}
+	b, _ := json.Marshal(req)
+	if logging.Debug() {
+		slog.Debug("mcp =>", "method", method, "line", truncate(string(b), 240))
+	}
+	_, err := stdin.Write(append(b, '\n'))
+	return err
+}
+
+func (p *mcpProc) readLoop(sc *bufio.Scanner) {
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var raw map[string]any
+		if json.Unmarshal([]byte(line), &raw) != nil {
+			continue
+		}
+		if logging.Debug() {
+			// 軽量に先頭だけログ
+			slog.DebugContext(p.logContext(lineRequestID(raw)), "mcp <=", "line", truncate(line, 240))
+		}
+		// handle server-initiated requests (e.g., approval elicitation) and notifications (e.g., codex/event)
+		if method, _ := raw["method"].(string); method != "" {
+			if id, ok := raw["id"]; ok && id != nil {
+				p.b.handleServerRequest(p, id, raw)
+			} else {
+				p.b.handleNotify(p, raw)
+			}
+			continue
+		}
+		switch v := raw["id"].(type) {
+		case float64:
+			id := int64(v)
+			if res, ok := raw["result"]; ok {
+				p.deliver(id, res)
+			} else if errObj, ok := raw["error"]; ok {
+				p.deliverError(id, errObj)
+			}
+		case string:
+			// 一部実装は id を文字列で返すことがある
+			if id, err := parseID(v); err == nil {
+				if res, ok := raw["result"]; ok {
+					p.deliver(id, res)
+				} else if errObj, ok := raw["error"]; ok {
+					p.deliverError(id, errObj)
+				}
+			}
+		}
+	}
+}
+
+// owner returns the channelID that issued the request id on this process.
+func (p *mcpProc) owner(id int64) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.owners[id]
+}
+
+// abortOf returns the channel closed when request id is cancelled, or nil.
+func (p *mcpProc) abortOf(id int64) <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if abort, ok := p.cancels[id]; ok {
+		return abort
+	}
+	return nil
+}
+
+// logContext returns the context of request id, for log lines about it.
+func (p *mcpProc) logContext(id int64) context.Context {
+	p.mu.Lock()
+	ctx := p.logCtxs[id]
+	p.mu.Unlock()
+	switch {
+	case ctx != nil:
+		return ctx
+	case id != 0:
+		return logging.With(context.Background(), logging.KeyRPC, id)
+	}
+	return context.Background()
+}
+
+// lineRequestID is the request a message from the server is about: the id of
+// a response, or _meta.requestId of a codex/event.
+func lineRequestID(raw map[string]any) int64 {
+	if _, ok := raw["method"]; !ok {
+		if id, ok := requestIDOf(raw["id"]); ok {
+			return id
+		}
+	}
+	params, _ := raw["params"].(map[string]any)
+	meta, _ := params["_meta"].(map[string]any)
+	id, _ := requestIDOf(meta["requestId"])
+	return id
+}
+
+// account returns the usage account of request id, if any.
+func (p *mcpProc) account(id int64) *turnAccount {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accounts[id]
+}
+
+// cancelChannel sends notifications/cancelled for every in-flight request the
+// channel owns and releases their waiters. It returns the cancelled ids.
+func (p *mcpProc) cancelChannel(channelID string) []int64 {
+	p.mu.Lock()
+	var ids []int64
+	for id, owner := range p.owners {
+		if owner != channelID {
+			continue
+		}
+		if abort, ok := p.cancels[id]; ok {
+			close(abort)
+			delete(p.cancels, id)
+			// late events for this request must not reopen the stream
+			delete(p.owners, id)
+			ids = append(ids, id)
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range ids {
+		_ = p.notify("notifications/cancelled", map[string]any{"requestId": id, "reason": "cancelled from Discord"})
+	}
+	return ids
+}
+
+func (p *mcpProc) deliver(id int64, v any) {
+	b, _ := json.Marshal(v)
+	p.mu.Lock()
+	ch, ok := p.pending[id]
+	if ok {
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+	if ok {
+		ch <- rpcReply{raw: b}
+	}
+}
+
+// deliverError fails request id with the error object of its response.
+func (p *mcpProc) deliverError(id int64, errObj any) {
+	p.mu.Lock()
+	ch, ok := p.pending[id]
+	if ok {
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+	if ok {
+		ch <- rpcReply{err: parseRPCError("", errObj)}
+	}
+}
+
+// close attempts to gracefully terminate the process.
+func (p *mcpProc) close() {
+	// try graceful shutdown via MCP before killing the process
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return
+	}
+	p.closing = true
+	cmd := p.cmd
+	stdin := p.stdin
+	dead := p.deadCh
+	if p.life != nil {
+		p.life.stopping = true
+	}
+	if p.idleTimer != nil {
+		p.idleTimer.Stop()
+	}
+	p.mu.Unlock()
+
+	if stdin != nil {
+		// best-effort shutdown sequence
+		ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+		// ignore errors; the goal is to nudge the server to exit
+		_, _ = p.request(ctx, "shutdown", map[string]any{})
+		cancel()
+		_ = p.notify("exit", map[string]any{})
+		time.Sleep(100 * time.Millisecond)
+		_ = stdin.Close()
+	}
+	if cmd != nil && dead != nil {
+		select {
+		case <-dead:
+		case <-time.After(1 * time.Second):
+			// try kill process group (Unix), then process
+			killProcessGroup(cmd)
+			_ = cmd.Process.Kill()
+		}
+	}
+	p.mu.Lock()
+	p.ready = false
+	p.stdin = nil
+	p.closing = false
+	p.mu.Unlock()
+}
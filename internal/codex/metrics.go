@@ -0,0 +1,51 @@
+package codex
+
+import (
+	"time"
+
+	"github.com/aoisensi/discodex/internal/metrics"
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+// countTokens adds a token_count event to the token metrics.
+func countTokens(channel string, u store.Usage) {
+	for typ, n := range map[string]int64{
+		"input":        u.Input,
+		"cached_input": u.CachedInput,
+		"output":       u.Output,
+		"reasoning":    u.Reasoning,
+	} {
+		if n > 0 {
+			metrics.Tokens.Add(float64(n), channel, typ)
+		}
+	}
+}
+
+// CollectMetrics sets the process gauges (uptime, pending requests); register
+// it with metrics.OnCollect.
+func (m *MCPBridge) CollectMetrics() {
+	m.mu.Lock()
+	procs := make([]*mcpProc, 0, len(m.procs))
+	for _, p := range m.procs {
+		procs = append(procs, p)
+	}
+	m.mu.Unlock()
+	metrics.MCPUptime.Reset()
+	metrics.MCPPending.Reset()
+	for _, p := range procs {
+		if !p.alive() {
+			continue
+		}
+		p.mu.Lock()
+		var started time.Time
+		if p.life != nil {
+			started = p.life.started
+		}
+		pending := len(p.pending)
+		p.mu.Unlock()
+		// processes sharing a workdir (different command/env): pending adds up,
+		// uptime is the last one seen
+		metrics.MCPUptime.Set(time.Since(started).Seconds(), p.spawn.Workdir)
+		metrics.MCPPending.Add(float64(pending), p.spawn.Workdir)
+	}
+}
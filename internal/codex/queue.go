@@ -0,0 +1,155 @@
+package codex
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aoisensi/discodex/internal/metrics"
+)
+
+// turnQueues holds one FIFO per conversation key. Every backend uses one so
+// that the queue position feedback is the same whichever runs the channel.
+type turnQueues struct {
+	mu sync.Mutex
+	m  map[string]*convoQueue
+}
+
+// convoQueue serializes the turns of one conversation: one runs, the rest wait
+// in FIFO order.
+type convoQueue struct {
+	running bool
+	waiting []*queueTicket
+}
+
+type queueTicket struct {
+	ready  chan struct{}
+	notify func(position int)
+}
+
+// WithQueueNotify attaches a callback told the prompt's queue position: 2 for
+// the first waiter behind the running turn, and so on; 0 once it starts
+// (immediately for a prompt that did not have to wait).
+func WithQueueNotify(ctx context.Context, fn func(position int)) context.Context {
+	return context.WithValue(ctx, ctxKeyQueueNotify, fn)
+}
+
+// acquire waits for the conversation's turn. The returned release must be
+// called when the turn is over. Waiting ends early with ErrCancelled when ctx
+// is done, which drops the prompt from the queue.
+func (tq *turnQueues) acquire(ctx context.Context, key string) (func(), error) {
+	notify, _ := ctx.Value(ctxKeyQueueNotify).(func(int))
+	tq.mu.Lock()
+	if tq.m == nil {
+		tq.m = map[string]*convoQueue{}
+	}
+	q := tq.m[key]
+	if q == nil {
+		q = &convoQueue{}
+		tq.m[key] = q
+	}
+	if !q.running {
+		q.running = true
+		tq.mu.Unlock()
+		if notify != nil {
+			notify(0)
+		}
+		return func() { tq.release(key) }, nil
+	}
+	t := &queueTicket{ready: make(chan struct{}), notify: notify}
+	q.waiting = append(q.waiting, t)
+	pos := len(q.waiting) + 1
+	metrics.QueueDepth.Set(float64(len(q.waiting)), key)
+	tq.mu.Unlock()
+	if notify != nil {
+		notify(pos)
+	}
+	select {
+	case <-t.ready:
+		if notify != nil {
+			notify(0)
+		}
+		return func() { tq.release(key) }, nil
+	case <-ctx.Done():
+		tq.mu.Lock()
+		select {
+		case <-t.ready:
+			// handed the turn just as we gave up: pass it on
+			tq.mu.Unlock()
+			tq.release(key)
+			return nil, ErrCancelled
+		default:
+		}
+		q.remove(t)
+		metrics.QueueDepth.Set(float64(len(q.waiting)), key)
+		rest := append([]*queueTicket(nil), q.waiting...)
+		tq.mu.Unlock()
+		renumber(rest)
+		return nil, ErrCancelled
+	}
+}
+
+// tryAcquire takes the conversation only when no turn is running or waiting,
+// without queueing; ok is false otherwise.
+func (tq *turnQueues) tryAcquire(key string) (release func(), ok bool) {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if tq.m == nil {
+		tq.m = map[string]*convoQueue{}
+	}
+	if tq.m[key] != nil {
+		return nil, false
+	}
+	tq.m[key] = &convoQueue{running: true}
+	return func() { tq.release(key) }, true
+}
+
+// release hands the conversation to the next waiter, if any.
+func (tq *turnQueues) release(key string) {
+	tq.mu.Lock()
+	q := tq.m[key]
+	if q == nil {
+		tq.mu.Unlock()
+		return
+	}
+	if len(q.waiting) == 0 {
+		delete(tq.m, key)
+		metrics.QueueDepth.Delete(key)
+		tq.mu.Unlock()
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	metrics.QueueDepth.Set(float64(len(q.waiting)), key)
+	rest := append([]*queueTicket(nil), q.waiting...)
+	close(next.ready)
+	tq.mu.Unlock()
+	renumber(rest)
+}
+
+func (q *convoQueue) remove(t *queueTicket) {
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// renumber tells the remaining waiters their new positions.
+func renumber(waiting []*queueTicket) {
+	for i, t := range waiting {
+		if t.notify != nil {
+			t.notify(i + 2)
+		}
+	}
+}
+
+// queued returns how many prompts wait behind the conversation's running turn.
+func (tq *turnQueues) queued(key string) int {
+	tq.mu.Lock()
+	defer tq.mu.Unlock()
+	if q := tq.m[key]; q != nil {
+		return len(q.waiting)
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package codex
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTryAcquire(t *testing.T) {
+	var tq turnQueues
+	release, err := tq.acquire(context.Background(), "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tq.tryAcquire("c"); ok {
+		t.Error("tryAcquire succeeded while a turn is running")
+	}
+	if _, ok := tq.tryAcquire("other"); !ok {
+		t.Error("tryAcquire failed for an idle conversation")
+	}
+	release()
+
+	reset, ok := tq.tryAcquire("c")
+	if !ok {
+		t.Fatal("tryAcquire failed after the turn ended")
+	}
+	started := make(chan struct{})
+	go func() {
+		r, err := tq.acquire(context.Background(), "c")
+		if err == nil {
+			r()
+		}
+		close(started)
+	}()
+	for tq.queued("c") == 0 {
+		time.Sleep(time.Millisecond) // until the turn waits behind the reset
+	}
+	reset()
+	<-started
+}
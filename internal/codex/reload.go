@@ -0,0 +1,57 @@
+package codex
+
+import (
+	"log/slog"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+func (m *MCPBridge) codexConf() config.Codex {
+	m.confMu.RLock()
+	defer m.confMu.RUnlock()
+	return m.conf
+}
+
+func (m *MCPBridge) quotaConf() config.Quota {
+	m.confMu.RLock()
+	defer m.confMu.RUnlock()
+	return m.quota
+}
+
+// Reload swaps in new [codex] settings and quotas. New turns use them right
+// away; processes whose (command, workdir, env) no longer match any channel
+// are retired: closed now when idle, otherwise after their last in-flight
+// request. Conversations on a retired process resume on the new one.
+// channels must have runtime overrides (/codex cwd) applied, or the processes
+// serving overridden channels are retired on every reload.
+func (m *MCPBridge) Reload(conf config.Codex, quota config.Quota, channels []config.Channel) {
+	m.confMu.Lock()
+	m.conf = conf
+	m.quota = quota
+	m.confMu.Unlock()
+
+	live := map[string]bool{procKey(conf, config.Channel{}): true}
+	for _, ch := range channels {
+		live[procKey(conf, ch)] = true
+	}
+	var retired []*mcpProc
+	m.mu.Lock()
+	for key, p := range m.procs {
+		if live[key] {
+			continue
+		}
+		delete(m.procs, key)
+		retired = append(retired, p)
+	}
+	m.mu.Unlock()
+	for _, p := range retired {
+		p.mu.Lock()
+		busy := len(p.pending) > 0
+		p.retiring = true
+		p.mu.Unlock()
+		slog.Debug("mcp: retiring process", "command", p.spawn.Command, "workdir", p.spawn.Workdir, "busy", busy)
+		if !busy {
+			go p.close()
+		}
+	}
+}
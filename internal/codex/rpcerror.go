@@ -0,0 +1,180 @@
+package codex
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC error codes the bridge tells apart.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// Kinds of RPCError that get their own user-facing message.
+const (
+	ErrorKindAuth          = "auth"
+	ErrorKindRateLimit     = "rate_limit"
+	ErrorKindContextWindow = "context_window"
+	// ErrorKindSessionNotFound: the conversation to reply to or resume does
+	// not exist (anymore).
+	ErrorKindSessionNotFound = "session_not_found"
+)
+
+// RPCError is the error object of a JSON-RPC response.
+type RPCError struct {
+	// Method is the request that failed.
+	Method  string          `json:"-"`
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	s := fmt.Sprintf("codex: %s failed: %s (code %d)", e.Method, e.Message, e.Code)
+	if len(e.Data) > 0 && string(e.Data) != "null" {
+		s += ": " + truncate(string(e.Data), 500)
+	}
+	return s
+}
+
+// statusText matches an HTTP status in prose: "status 429", "HTTP 401",
+// "status code: 403", "429 Too Many Requests".
+var statusText = regexp.MustCompile(`(?i)\b(?:http|status(?:[ _]code)?)\s*[:=]?\s*([1-5][0-9]{2})\b|\b([1-5][0-9]{2}) (?:too many requests|unauthorized|forbidden)\b`)
+
+// Kind classifies the error for the user: ErrorKindAuth, ErrorKindRateLimit,
+// ErrorKindContextWindow, ErrorKindSessionNotFound, or "" when it is none of
+// them. Protocol errors (the request itself was malformed) have no kind.
+// Codex reports the others as internal errors, so the structured data is
+// looked at first (error type/code, HTTP status), then the message.
+func (e *RPCError) Kind() string {
+	switch e.Code {
+	case CodeParseError, CodeInvalidRequest, CodeMethodNotFound:
+		return ""
+	}
+	var data any
+	_ = json.Unmarshal(e.Data, &data)
+	codes, statuses := errorFields(data, nil, nil)
+	for _, c := range codes {
+		if k := codeKind(c); k != "" {
+			return k
+		}
+	}
+	for _, st := range statuses {
+		if k := statusKind(st); k != "" {
+			return k
+		}
+	}
+	text := strings.ToLower(e.Message)
+	if s, ok := data.(string); ok {
+		text += " " + strings.ToLower(s)
+	}
+	if k := phraseKind(text); k != "" {
+		return k
+	}
+	for _, m := range statusText.FindAllStringSubmatch(text, -1) {
+		st, _ := strconv.Atoi(m[1] + m[2])
+		if k := statusKind(st); k != "" {
+			return k
+		}
+	}
+	return ""
+}
+
+// errorFields collects the error type/code strings and HTTP statuses found in
+// a decoded data object, nested "error" objects included.
+func errorFields(v any, codes []string, statuses []int) ([]string, []int) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return codes, statuses
+	}
+	for _, k := range []string{"code", "type", "error_type", "kind"} {
+		if s, ok := obj[k].(string); ok && s != "" {
+			codes = append(codes, strings.ToLower(s))
+		}
+	}
+	for _, k := range []string{"status", "status_code", "http_status", "code"} {
+		if n, ok := obj[k].(float64); ok {
+			statuses = append(statuses, int(n))
+		}
+	}
+	if nested, ok := obj["error"]; ok {
+		return errorFields(nested, codes, statuses)
+	}
+	return codes, statuses
+}
+
+// codeKind maps OpenAI/Codex error types and codes.
+func codeKind(c string) string {
+	switch c {
+	case "context_length_exceeded", "context_window_exceeded":
+		return ErrorKindContextWindow
+	case "rate_limit_exceeded", "rate_limit_error", "usage_limit_reached", "insufficient_quota", "too_many_requests":
+		return ErrorKindRateLimit
+	case "invalid_api_key", "authentication_error", "unauthorized", "permission_denied", "not_logged_in":
+		return ErrorKindAuth
+	case "session_not_found", "conversation_not_found":
+		return ErrorKindSessionNotFound
+	}
+	return ""
+}
+
+func statusKind(st int) string {
+	switch st {
+	case 429:
+		return ErrorKindRateLimit
+	case 401, 403:
+		return ErrorKindAuth
+	}
+	return ""
+}
+
+func phraseKind(text string) string {
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(text, w) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("context window", "context_length_exceeded", "context length", "maximum context"):
+		return ErrorKindContextWindow
+	case has("rate limit", "rate_limit", "usage limit", "too many requests"):
+		return ErrorKindRateLimit
+	case has("unauthorized", "authentication failed", "not logged in", "invalid api key", "invalid_api_key"):
+		return ErrorKindAuth
+	case sessionGone(text):
+		return ErrorKindSessionNotFound
+	}
+	return ""
+}
+
+// sessionGone reports whether text says the conversation or session file to
+// continue does not exist (anymore).
+func sessionGone(text string) bool {
+	text = strings.ToLower(text)
+	for _, w := range []string{"session not found", "conversation not found", "unknown conversation", "no such conversation", "no conversation found", "failed to resume"} {
+		if strings.Contains(text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRPCError decodes the error object of a response to method.
+func parseRPCError(method string, v any) *RPCError {
+	e := &RPCError{Method: method, Code: CodeInternalError}
+	b, _ := json.Marshal(v)
+	if json.Unmarshal(b, e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
@@ -0,0 +1,44 @@
+package codex
+
+import "testing"
+
+func TestRPCErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  RPCError
+		want string
+	}{
+		{"plain internal error", RPCError{Code: CodeInternalError, Message: "something broke"}, ""},
+		{"rate limit phrase", RPCError{Code: CodeInternalError, Message: "stream error: rate limit reached"}, ErrorKindRateLimit},
+		{"usage limit phrase", RPCError{Code: CodeInternalError, Message: "You've hit your usage limit"}, ErrorKindRateLimit},
+		{"context window phrase", RPCError{Code: CodeInternalError, Message: "input exceeds the context window of this model"}, ErrorKindContextWindow},
+		{"auth phrase", RPCError{Code: CodeInternalError, Message: "not logged in; run codex login"}, ErrorKindAuth},
+
+		{"data code", RPCError{Code: CodeInternalError, Message: "request failed", Data: []byte(`{"code":"rate_limit_exceeded"}`)}, ErrorKindRateLimit},
+		{"nested data type", RPCError{Code: CodeInternalError, Message: "request failed", Data: []byte(`{"error":{"type":"invalid_api_key"}}`)}, ErrorKindAuth},
+		{"data status", RPCError{Code: CodeInternalError, Message: "request failed", Data: []byte(`{"status":429}`)}, ErrorKindRateLimit},
+		{"data numeric code", RPCError{Code: CodeInternalError, Message: "request failed", Data: []byte(`{"code":401}`)}, ErrorKindAuth},
+		{"data code wins over message", RPCError{Code: CodeInternalError, Message: "rate limit", Data: []byte(`{"code":"context_length_exceeded"}`)}, ErrorKindContextWindow},
+
+		{"status in prose", RPCError{Code: CodeInternalError, Message: "unexpected status 401 from api"}, ErrorKindAuth},
+		{"http status in prose", RPCError{Code: CodeInternalError, Message: "HTTP 429"}, ErrorKindRateLimit},
+		{"status with reason", RPCError{Code: CodeInternalError, Message: "403 Forbidden"}, ErrorKindAuth},
+		{"number in a path", RPCError{Code: CodeInternalError, Message: "cannot open /tmp/429/out.txt"}, ""},
+		{"number as a line", RPCError{Code: CodeInternalError, Message: "parse error at line 401"}, ""},
+		{"number in an id", RPCError{Code: CodeInternalError, Message: "request 14031 failed", Data: []byte(`{"id":"req_4291"}`)}, ""},
+		{"other status", RPCError{Code: CodeInternalError, Message: "status 500"}, ""},
+
+		{"session not found", RPCError{Code: CodeInvalidParams, Message: "Session not found for conversation_id: abc"}, ErrorKindSessionNotFound},
+		{"session not found code", RPCError{Code: CodeInternalError, Message: "failed", Data: []byte(`{"code":"conversation_not_found"}`)}, ErrorKindSessionNotFound},
+		{"invalid params", RPCError{Code: CodeInvalidParams, Message: "missing field prompt"}, ""},
+		{"method not found", RPCError{Code: CodeMethodNotFound, Message: "rate limit of tools/list"}, ""},
+		{"parse error", RPCError{Code: CodeParseError, Message: "unauthorized token"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.err.Kind(); got != tt.want {
+				t.Errorf("Kind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
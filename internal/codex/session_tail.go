@@ -0,0 +1,118 @@
+package codex
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+// tailEvent is one event of a Codex session file (rollout JSONL), decoded into
+// the shapes MCPBridge reports for codex/event.
+type tailEvent struct {
+	// Type is the event msg type (agent_message_delta, token_count, ...).
+	Type string
+	// Text is the message, reasoning or delta text; for task_complete the
+	// last agent message.
+	Text  string
+	Usage store.Usage
+	// Event is set for tool, plan and diff events and for TurnComplete.
+	Event Event
+}
+
+// tailJSONL sends the events appended to path until done is closed.
+func tailJSONL(path string, out chan<- tailEvent, done <-chan struct{}) {
+	// open and seek to end
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// start from end to avoid flooding old logs
+	if _, err := f.Seek(0, io.SeekEnd); err != nil { /* ignore */
+	}
+	r := bufio.NewReader(f)
+	var partial string
+	for {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			// keep a half-written line until the rest arrives
+			partial += line
+			select {
+			case <-done:
+				return
+			case <-time.After(300 * time.Millisecond):
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		line, partial = partial+line, ""
+		ev, ok := parseSessionLine(line)
+		if !ok {
+			continue
+		}
+		select {
+		case out <- ev:
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseSessionLine decodes one session file line. Event messages come as
+// {type: "event_msg", payload: {...}}, or as {msg: {...}} / a bare msg in
+// older files; response items and metadata lines are skipped.
+func parseSessionLine(line string) (tailEvent, bool) {
+	s := strings.TrimSpace(line)
+	if s == "" {
+		return tailEvent{}, false
+	}
+	var v map[string]any
+	if json.Unmarshal([]byte(s), &v) != nil {
+		return tailEvent{}, false
+	}
+	msg := v
+	if p, ok := v["payload"].(map[string]any); ok {
+		if t, _ := v["type"].(string); t != "event_msg" {
+			return tailEvent{}, false
+		}
+		msg = p
+	} else if m, ok := v["msg"].(map[string]any); ok {
+		msg = m
+	}
+	typ, _ := msg["type"].(string)
+	ev := tailEvent{Type: typ}
+	switch typ {
+	case "":
+		return tailEvent{}, false
+	case "agent_message_delta", "agent_reasoning_delta":
+		ev.Text, _ = msg["delta"].(string)
+		return ev, ev.Text != ""
+	case "agent_message", "agent_reasoning":
+		m, _ := msg["message"].(string)
+		ev.Text = strings.TrimSpace(m)
+		return ev, ev.Text != ""
+	case "token_count":
+		u, ok := parseTokenCount(msg)
+		ev.Usage = u
+		return ev, ok
+	case "task_complete":
+		m, _ := msg["last_agent_message"].(string)
+		ev.Text = strings.TrimSpace(m)
+		ev.Event = TurnComplete{}
+		return ev, true
+	case "turn_aborted":
+		ev.Event = TurnComplete{Aborted: true}
+		return ev, true
+	}
+	e, ok := parseEvent(msg)
+	ev.Event = e
+	return ev, ok
+}
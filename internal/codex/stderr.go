@@ -0,0 +1,79 @@
+package codex
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// stderrLines is how many lines of a child's stderr are kept.
+const stderrLines = 50
+
+// lineRing keeps the last lines written to it. It is the stderr of a `codex
+// mcp` child, kept apart from the JSON-RPC stream on stdout.
+type lineRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+	// unterminated tail of the last write
+	part string
+}
+
+func newLineRing(n int) *lineRing { return &lineRing{lines: make([]string, n)} }
+
+func (r *lineRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.part + string(p)
+	for {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			break
+		}
+		r.add(strings.TrimRight(s[:i], "\r"))
+		s = s[i+1:]
+	}
+	// keep a runaway line from growing without bound
+	if len(s) > 4096 {
+		r.add(s)
+		s = ""
+	}
+	r.part = s
+	return len(p), nil
+}
+
+func (r *lineRing) add(line string) {
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// tail returns up to n of the most recent lines, oldest first, with secrets
+// redacted.
+func (r *lineRing) tail(n int) []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var all []string
+	if r.full {
+		all = append(all, r.lines[r.next:]...)
+	}
+	all = append(all, r.lines[:r.next]...)
+	if r.part != "" {
+		all = append(all, r.part)
+	}
+	if n > 0 && len(all) > n {
+		all = all[len(all)-n:]
+	}
+	out := make([]string, len(all))
+	for i, l := range all {
+		out[i] = config.Redact(l)
+	}
+	return out
+}
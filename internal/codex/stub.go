@@ -9,8 +9,11 @@ import (
 )
 
 // Client is a placeholder for a Codex client that would live inside WSL.
-// For now, it just echoes the prompt with a canned header and distro.
-type Client struct{}
+// For now, it just echoes the prompt with a canned header and distro. It is the
+// "stub" backend, handy for checking the Discord side without Codex.
+type Client struct {
+	queues turnQueues
+}
 
 func NewClient() *Client { return &Client{} }
 
@@ -23,6 +26,11 @@ func (c *Client) Chat(ctx context.Context, ch config.Channel, prompt string) (st
 }
 
 func (c *Client) ChatMulti(ctx context.Context, ch config.Channel, prompt string) ([]string, error) {
+	release, err := c.queues.acquire(ctx, ch.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	s, err := c.Chat(ctx, ch, prompt)
 	if err != nil {
 		return nil, err
@@ -32,3 +40,12 @@ func (c *Client) ChatMulti(ctx context.Context, ch config.Channel, prompt string
 	}
 	return []string{s}, nil
 }
+
+func (c *Client) Reset(channelID string) error { return nil }
+func (c *Client) Cancel(channelID string) bool { return false }
+func (c *Client) Close()                       {}
+func (c *Client) SetHandlers(h Handlers)       {}
+
+func (c *Client) Status(ch config.Channel) Status {
+	return Status{Backend: config.BackendStub, Queued: c.queues.queued(ch.ChannelID)}
+}
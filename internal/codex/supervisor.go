@@ -0,0 +1,285 @@
+package codex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/metrics"
+)
+
+// Supervision of `codex mcp` children: a crashed process is restarted in the
+// background with exponential backoff; after too many crashes in a short
+// window the bridge gives up on it for a cooldown and reports it.
+const (
+	initTimeout = 20 * time.Second
+
+	pingInterval = 30 * time.Second
+	pingTimeout  = 10 * time.Second
+	// consecutive failed pings before the child is considered hung
+	pingFailures = 2
+
+	backoffMin = 1 * time.Second
+	backoffMax = 60 * time.Second
+	// a child that ran this long resets the crash history
+	stableAfter = 2 * time.Minute
+
+	crashLoopCount  = 5
+	crashLoopWindow = 2 * time.Minute
+	crashCooldown   = 5 * time.Minute
+
+	// stderr lines attached to an ExitError
+	stderrReport = 20
+)
+
+// rpcReply is what a pending request receives: the response, or the error
+// that ended the wait (the child died).
+type rpcReply struct {
+	raw []byte
+	err error
+}
+
+// childLife belongs to one spawned child.
+type childLife struct {
+	started time.Time
+	// set when discodex itself stops the child (idle, reload, shutdown);
+	// such an exit is not a crash
+	stopping bool
+	// why discodex killed it, if it did (e.g. ping timeout)
+	reason string
+}
+
+// ExitError fails the requests in flight when their process exits.
+type ExitError struct {
+	// exit code, -1 when killed by a signal or unknown
+	Code   int
+	Reason string
+	// Uptime is how long the child ran.
+	Uptime time.Duration
+	// Stderr holds the last lines the child wrote to stderr.
+	Stderr []string
+}
+
+func (e *ExitError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("codex: MCP process exited (%s)", e.Reason)
+	}
+	return fmt.Sprintf("codex: MCP process exited with code %d", e.Code)
+}
+
+// CrashLoopError is returned while a process that kept crashing is in its
+// cooldown.
+type CrashLoopError struct {
+	Failures int
+	Last     error
+	RetryAt  time.Time
+}
+
+func (e *CrashLoopError) Error() string {
+	return fmt.Sprintf("codex: MCP process crashed %d times; retrying after %s: %v", e.Failures, e.RetryAt.Format("15:04:05"), e.Last)
+}
+
+func (e *CrashLoopError) Unwrap() error { return e.Last }
+
+// wait reaps the child, fails its pending requests and schedules a restart
+// when the exit was not intended.
+func (p *mcpProc) wait(cmd *exec.Cmd, life *childLife, dead chan struct{}) {
+	werr := cmd.Wait()
+	p.mu.Lock()
+	p.ready = false
+	close(dead)
+	stopping, reason := life.stopping, life.reason
+	stderr := p.stderr
+	p.mu.Unlock()
+
+	exit := &ExitError{Code: -1, Reason: reason, Uptime: time.Since(life.started), Stderr: stderr.tail(stderrReport)}
+	if cmd.ProcessState != nil {
+		exit.Code = cmd.ProcessState.ExitCode()
+	}
+	if exit.Reason == "" && werr != nil && exit.Code < 0 {
+		exit.Reason = werr.Error()
+	}
+	p.failPending(exit)
+	p.b.procDown()
+	if stopping {
+		return
+	}
+	slog.Warn("mcp: process exited unexpectedly", "workdir", p.spawn.Workdir, "code", exit.Code, "reason", exit.Reason, "uptime", exit.Uptime)
+	if p.b.onExit != nil {
+		p.b.onExit(exit)
+	}
+	if p.failed(exit, exit.Uptime) {
+		return
+	}
+	p.mu.Lock()
+	delay, retiring := time.Until(p.nextStart), p.retiring
+	p.mu.Unlock()
+	if retiring {
+		return
+	}
+	time.AfterFunc(max(delay, 0), p.restart)
+}
+
+// restart brings a crashed child back in the background.
+func (p *mcpProc) restart() {
+	p.mu.Lock()
+	skip := p.retiring || p.gaveUp != nil
+	p.mu.Unlock()
+	if skip {
+		return
+	}
+	if err := p.ensureStarted(context.Background()); err != nil {
+		slog.Error("mcp: restart failed", "workdir", p.spawn.Workdir, "error", err)
+		p.mu.Lock()
+		again := !p.retiring && p.gaveUp == nil
+		delay := time.Until(p.nextStart)
+		p.mu.Unlock()
+		if again {
+			time.AfterFunc(max(delay, 0), p.restart)
+		}
+		return
+	}
+	p.mu.Lock()
+	p.restarts++
+	p.mu.Unlock()
+	metrics.MCPRestarts.Inc(p.spawn.Workdir)
+	slog.Info("mcp: restarted", "workdir", p.spawn.Workdir)
+}
+
+// failPending ends every request still waiting on the child with err and
+// closes the streams they opened.
+func (p *mcpProc) failPending(err error) {
+	p.mu.Lock()
+	pending := p.pending
+	owners := make(map[int64]string, len(p.owners))
+	for id, owner := range p.owners {
+		owners[id] = owner
+	}
+	p.pending = map[int64]chan rpcReply{}
+	p.mu.Unlock()
+	for id, ch := range pending {
+		ch <- rpcReply{err: err}
+		owner := owners[id]
+		if owner == "" {
+			continue
+		}
+		if p.b.onAgentDone != nil {
+			p.b.onAgentDone(owner, id, "")
+		}
+		if p.b.onReasoningEnd != nil {
+			p.b.onReasoningEnd(owner)
+		}
+	}
+}
+
+// failed records a crash or failed start and sets the next backoff. It
+// reports true when the process crashed too often and is given up on.
+func (p *mcpProc) failed(err error, uptime time.Duration) bool {
+	now := time.Now()
+	p.mu.Lock()
+	if uptime >= stableAfter {
+		p.failures, p.backoff = nil, 0
+	}
+	recent := p.failures[:0]
+	for _, t := range p.failures {
+		if now.Sub(t) < crashLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	p.failures = append(recent, now)
+	if p.backoff == 0 {
+		p.backoff = backoffMin
+	} else {
+		p.backoff = min(p.backoff*2, backoffMax)
+	}
+	p.nextStart = now.Add(p.backoff)
+	var gaveUp *CrashLoopError
+	if len(p.failures) >= crashLoopCount {
+		gaveUp = &CrashLoopError{Failures: len(p.failures), Last: err, RetryAt: now.Add(crashCooldown)}
+		p.gaveUp = gaveUp
+		p.failures, p.backoff = nil, 0
+		p.nextStart = gaveUp.RetryAt
+	}
+	channels := make([]string, 0, len(p.channels))
+	for id := range p.channels {
+		channels = append(channels, id)
+	}
+	p.mu.Unlock()
+	if gaveUp == nil {
+		return false
+	}
+	sort.Strings(channels)
+	slog.Error("mcp: giving up after repeated crashes", "workdir", p.spawn.Workdir, "failures", gaveUp.Failures, "retry_at", gaveUp.RetryAt, "error", err)
+	if p.b.onGiveUp != nil {
+		p.b.onGiveUp(channels, gaveUp)
+	}
+	return true
+}
+
+// waitRestart blocks until the backoff has passed; during a crash-loop
+// cooldown it fails right away.
+func (p *mcpProc) waitRestart(ctx context.Context) error {
+	p.mu.Lock()
+	gaveUp, next := p.gaveUp, p.nextStart
+	if gaveUp != nil && !time.Now().Before(gaveUp.RetryAt) {
+		// cooldown over: allow one more try
+		p.gaveUp = nil
+		gaveUp = nil
+	}
+	p.mu.Unlock()
+	if gaveUp != nil {
+		return gaveUp
+	}
+	d := time.Until(next)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// pingLoop probes the child; a child that stops answering is killed so the
+// supervisor restarts it.
+func (p *mcpProc) pingLoop(life *childLife, dead chan struct{}) {
+	t := time.NewTicker(pingInterval)
+	defer t.Stop()
+	misses := 0
+	for {
+		select {
+		case <-dead:
+			return
+		case <-t.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		_, err := p.request(ctx, "ping", map[string]any{})
+		cancel()
+		// an error response still shows the server is reading its input
+		var re *RPCError
+		if err == nil || errors.As(err, &re) {
+			misses = 0
+			continue
+		}
+		p.mu.Lock()
+		stopping := life.stopping
+		p.mu.Unlock()
+		if stopping {
+			return
+		}
+		misses++
+		slog.Debug("mcp: ping failed", "workdir", p.spawn.Workdir, "misses", misses, "limit", pingFailures, "error", err)
+		if misses >= pingFailures {
+			p.kill("no response to ping")
+			return
+		}
+	}
+}
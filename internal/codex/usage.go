@@ -0,0 +1,257 @@
+package codex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+// WithUserID attaches the Discord user id used for usage accounting and quotas.
+func WithUserID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyUserID, id)
+}
+
+// UserIDFrom returns the id set by WithUserID, or "".
+func UserIDFrom(ctx context.Context) string {
+	s, _ := ctx.Value(ctxKeyUserID).(string)
+	return s
+}
+
+// turnAccount collects the token_count events of one tools/call request.
+type turnAccount struct {
+	channelID string
+	// budgetChannel is the configured channel (the parent for threads)
+	budgetChannel string
+	userID        string
+	// when tools/call was sent, for the time to the first delta
+	started time.Time
+
+	mu    sync.Mutex
+	usage store.Usage
+	// set once the first agent_message_delta arrived
+	gotDelta bool
+}
+
+func (a *turnAccount) add(u store.Usage) {
+	a.mu.Lock()
+	a.usage = a.usage.Add(u)
+	a.mu.Unlock()
+}
+
+// firstDelta reports true for the first agent_message_delta of the turn.
+func (a *turnAccount) firstDelta() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	first := !a.gotDelta
+	a.gotDelta = true
+	return first
+}
+
+func (a *turnAccount) total() store.Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.usage
+}
+
+func accountFrom(ctx context.Context) *turnAccount {
+	a, _ := ctx.Value(ctxKeyAccount).(*turnAccount)
+	return a
+}
+
+// QuotaError is returned by ChatMulti when a user or channel is over budget.
+type QuotaError struct {
+	// Scope is "user" or "channel"
+	Scope string
+	// Period is "daily" or "monthly"
+	Period string
+	Used   int64
+	Limit  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("codex: %s %s token quota exceeded (%d/%d)", e.Scope, e.Period, e.Used, e.Limit)
+}
+
+// UsageReport is the token usage seen from one channel and user.
+type UsageReport struct {
+	// LastTurn is the most recent turn in the channel.
+	LastTurn     store.Usage
+	Conversation store.Usage
+
+	ChannelDaily, ChannelMonthly, ChannelTotal store.Usage
+	UserDaily, UserMonthly, UserTotal          store.Usage
+
+	Quota config.Quota
+}
+
+// WithQuota sets the global token budgets; channels may override them.
+func (m *MCPBridge) WithQuota(q config.Quota) *MCPBridge {
+	m.confMu.Lock()
+	m.quota = q
+	m.confMu.Unlock()
+	return m
+}
+
+// budgetChannel is the channel that usage is billed to: the configured parent
+// for threads.
+func budgetChannel(ch config.Channel) string {
+	if ch.ParentID != "" {
+		return ch.ParentID
+	}
+	return ch.ChannelID
+}
+
+func dayKey(t time.Time) string   { return t.Format("2006-01-02") }
+func monthKey(t time.Time) string { return t.Format("2006-01") }
+
+// stalePeriod reports whether key is a daily or monthly counter of an earlier
+// day or month than now. Only the current periods are read, so older ones
+// are dropped instead of piling up in the state file.
+func stalePeriod(key string, now time.Time) bool {
+	if i := strings.LastIndex(key, ":d:"); i >= 0 {
+		return key[i+3:] != dayKey(now)
+	}
+	if i := strings.LastIndex(key, ":m:"); i >= 0 {
+		return key[i+3:] != monthKey(now)
+	}
+	return false
+}
+
+func (m *MCPBridge) usageStore() store.Store {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store == nil {
+		m.store = store.NewMemory()
+	}
+	return m.store
+}
+
+func (m *MCPBridge) readUsage(key string) store.Usage {
+	u, err := m.usageStore().Usage(key)
+	if err != nil {
+		slog.Error("state: read usage", "key", key, "error", err)
+	}
+	return u
+}
+
+// checkQuota refuses a new turn when the user or channel is over budget.
+func (m *MCPBridge) checkQuota(ch config.Channel, userID string) error {
+	q := m.quotaConf().Merge(ch.Quota)
+	now := time.Now()
+	check := func(scope, period, key string, limit int64) error {
+		if limit <= 0 {
+			return nil
+		}
+		if used := m.readUsage(key).Total; used >= limit {
+			return &QuotaError{Scope: scope, Period: period, Used: used, Limit: limit}
+		}
+		return nil
+	}
+	bc := budgetChannel(ch)
+	if userID != "" {
+		if err := check("user", "daily", "user:"+userID+":d:"+dayKey(now), q.UserDailyTokens); err != nil {
+			return err
+		}
+		if err := check("user", "monthly", "user:"+userID+":m:"+monthKey(now), q.UserMonthlyTokens); err != nil {
+			return err
+		}
+	}
+	if err := check("channel", "daily", "channel:"+bc+":d:"+dayKey(now), q.ChannelDailyTokens); err != nil {
+		return err
+	}
+	return check("channel", "monthly", "channel:"+bc+":m:"+monthKey(now), q.ChannelMonthlyTokens)
+}
+
+// recordUsage adds a finished turn to the conversation, channel and user
+// counters.
+func (m *MCPBridge) recordUsage(a *turnAccount, conversationID string) {
+	u := a.total()
+	m.mu.Lock()
+	m.lastTurn[a.channelID] = u
+	m.mu.Unlock()
+	if u == (store.Usage{}) {
+		return
+	}
+	now := time.Now()
+	keys := []string{
+		"total",
+		"channel:" + a.budgetChannel,
+		"channel:" + a.budgetChannel + ":d:" + dayKey(now),
+		"channel:" + a.budgetChannel + ":m:" + monthKey(now),
+	}
+	if conversationID != "" {
+		keys = append(keys, "conv:"+conversationID)
+	}
+	if a.userID != "" {
+		keys = append(keys,
+			"user:"+a.userID,
+			"user:"+a.userID+":d:"+dayKey(now),
+			"user:"+a.userID+":m:"+monthKey(now))
+	}
+	if err := m.usageStore().AddUsage(keys, u); err != nil {
+		slog.Error("state: save usage", "error", err)
+	}
+	if err := m.usageStore().PruneUsage(func(key string) bool { return stalePeriod(key, now) }); err != nil {
+		slog.Error("state: prune usage", "error", err)
+	}
+	slog.Debug("usage: turn", logging.KeyChannel, a.channelID, logging.KeyUser, a.userID, logging.KeyConversation, conversationID, "input", u.Input, "output", u.Output, "total", u.Total)
+}
+
+// Usage reports token usage for the channel's conversation, the channel and the user.
+func (m *MCPBridge) Usage(ch config.Channel, userID string) UsageReport {
+	now := time.Now()
+	bc := budgetChannel(ch)
+	r := UsageReport{
+		ChannelDaily:   m.readUsage("channel:" + bc + ":d:" + dayKey(now)),
+		ChannelMonthly: m.readUsage("channel:" + bc + ":m:" + monthKey(now)),
+		ChannelTotal:   m.readUsage("channel:" + bc),
+		Quota:          m.quotaConf().Merge(ch.Quota),
+	}
+	if cs, ok := m.conversation(ch.ChannelID); ok {
+		r.Conversation = m.readUsage("conv:" + cs.ConversationID)
+	}
+	if userID != "" {
+		r.UserDaily = m.readUsage("user:" + userID + ":d:" + dayKey(now))
+		r.UserMonthly = m.readUsage("user:" + userID + ":m:" + monthKey(now))
+		r.UserTotal = m.readUsage("user:" + userID)
+	}
+	m.mu.Lock()
+	r.LastTurn = m.lastTurn[ch.ChannelID]
+	m.mu.Unlock()
+	return r
+}
+
+// parseTokenCount reads a token_count msg: either {info: {last_token_usage}}
+// or the older flat form with the counters on the msg itself.
+func parseTokenCount(msg map[string]any) (store.Usage, bool) {
+	src := msg
+	if info, ok := msg["info"].(map[string]any); ok {
+		last, ok := info["last_token_usage"].(map[string]any)
+		if !ok {
+			return store.Usage{}, false
+		}
+		src = last
+	} else if _, ok := msg["info"]; ok {
+		// info: null before the first model response
+		return store.Usage{}, false
+	}
+	num := func(k string) int64 { f, _ := src[k].(float64); return int64(f) }
+	u := store.Usage{
+		Input:       num("input_tokens"),
+		CachedInput: num("cached_input_tokens"),
+		Output:      num("output_tokens"),
+		Reasoning:   num("reasoning_output_tokens"),
+		Total:       num("total_tokens"),
+	}
+	if u.Total == 0 {
+		u.Total = u.Input + u.Output
+	}
+	return u, u != (store.Usage{})
+}
@@ -0,0 +1,62 @@
+package codex
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+func TestStalePeriod(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"total", false},
+		{"channel:1", false},
+		{"conv:0199a-uuid", false},
+		{"user:2", false},
+		{"channel:1:d:2026-10-16", false},
+		{"channel:1:d:2026-10-15", true},
+		{"user:2:d:2025-10-16", true},
+		{"channel:1:m:2026-10", false},
+		{"user:2:m:2026-09", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := stalePeriod(tt.key, now); got != tt.want {
+				t.Errorf("stalePeriod(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordUsagePrunes(t *testing.T) {
+	st := store.NewMemory()
+	if err := st.AddUsage([]string{"channel:1:d:2000-01-01", "channel:1:m:2000-01", "channel:1"}, store.Usage{Total: 5}); err != nil {
+		t.Fatal(err)
+	}
+	m := NewMCPBridge(config.Codex{}).WithStore(st)
+	a := &turnAccount{channelID: "1", budgetChannel: "1"}
+	a.add(store.Usage{Total: 3})
+	m.recordUsage(a, "")
+
+	var keys []string
+	for _, k := range []string{"channel:1:d:2000-01-01", "channel:1:m:2000-01", "channel:1", "total"} {
+		if u, _ := st.Usage(k); u != (store.Usage{}) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if want := []string{"channel:1", "total"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("counters left = %v, want %v", keys, want)
+	}
+	now := time.Now()
+	if u, _ := st.Usage("channel:1:d:" + dayKey(now)); u.Total != 3 {
+		t.Errorf("today's counter = %d, want 3", u.Total)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	alice  = "111111111111111111"
+	bob    = "111111111111111112"
+	mods   = "222222222222222222"
+	guild  = "333333333333333333"
+	other  = "333333333333333334"
+	nobody = "999999999999999999"
+)
+
+func TestACLAllows(t *testing.T) {
+	type who struct {
+		user, guild string
+		roles       []string
+	}
+	var (
+		anyone    = who{user: nobody, guild: other}
+		asAlice   = who{user: alice, guild: guild}
+		asBob     = who{user: bob, guild: guild}
+		moderator = who{user: nobody, guild: guild, roles: []string{mods}}
+	)
+	tests := []struct {
+		name  string
+		acl   ACL
+		level string
+		who   who
+		want  bool
+	}{
+		{"unset chat allows everyone", ACL{}, ACLChat, anyone, true},
+		{"unset reset falls back to open chat", ACL{}, ACLReset, anyone, true},
+		{"unset approve denies", ACL{}, ACLApprove, anyone, false},
+		{"unset admin denies", ACL{}, ACLAdmin, anyone, false},
+		{"unknown level is chat", ACL{}, "other", anyone, true},
+
+		{"chat lists user", ACL{Chat: Principals{Users: []string{alice}}}, ACLChat, asAlice, true},
+		{"chat excludes others", ACL{Chat: Principals{Users: []string{alice}}}, ACLChat, asBob, false},
+		{"chat by role", ACL{Chat: Principals{Roles: []string{mods}}}, ACLChat, moderator, true},
+		{"chat by guild", ACL{Chat: Principals{Guilds: []string{guild}}}, ACLChat, asBob, true},
+		{"chat by guild, other guild", ACL{Chat: Principals{Guilds: []string{guild}}}, ACLChat, anyone, false},
+		{"empty guild never matches", ACL{Chat: Principals{Guilds: []string{guild}}}, ACLChat, who{user: bob}, false},
+
+		{"reset falls back to chat", ACL{Chat: Principals{Users: []string{alice}}}, ACLReset, asAlice, true},
+		{"reset falls back to chat, denied", ACL{Chat: Principals{Users: []string{alice}}}, ACLReset, asBob, false},
+		{"reset overrides chat", ACL{Chat: Principals{Users: []string{alice}}, Reset: Principals{Users: []string{bob}}}, ACLReset, asAlice, false},
+
+		{"chat users are not approvers", ACL{Chat: Principals{Users: []string{alice}}}, ACLApprove, asAlice, false},
+		{"chat users are not admins", ACL{Chat: Principals{Users: []string{alice}}}, ACLAdmin, asAlice, false},
+		{"approve lists user", ACL{Approve: Principals{Users: []string{bob}}}, ACLApprove, asBob, true},
+		{"approve is not admin", ACL{Approve: Principals{Users: []string{bob}}}, ACLAdmin, asBob, false},
+		{"admin lists role", ACL{Admin: Principals{Roles: []string{mods}}}, ACLAdmin, moderator, true},
+
+		{"admin passes chat", ACL{Chat: Principals{Users: []string{bob}}, Admin: Principals{Users: []string{alice}}}, ACLChat, asAlice, true},
+		{"admin passes approve", ACL{Approve: Principals{Users: []string{bob}}, Admin: Principals{Users: []string{alice}}}, ACLApprove, asAlice, true},
+		{"admin passes reset", ACL{Reset: Principals{Users: []string{bob}}, Admin: Principals{Users: []string{alice}}}, ACLReset, asAlice, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.acl.Allows(tt.level, tt.who.user, tt.who.guild, tt.who.roles); got != tt.want {
+				t.Errorf("Allows(%s, %+v) = %v, want %v", tt.level, tt.who, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLMerge(t *testing.T) {
+	base := ACL{
+		Chat:    Principals{Roles: []string{mods}},
+		Approve: Principals{Users: []string{alice}},
+		Admin:   Principals{Users: []string{alice}},
+	}
+	tests := []struct {
+		name string
+		over ACL
+		want ACL
+	}{
+		{"empty override keeps base", ACL{}, base},
+		{
+			name: "overrides only the given levels",
+			over: ACL{Chat: Principals{Users: []string{bob}}, Reset: Principals{Guilds: []string{guild}}},
+			want: ACL{
+				Chat:    Principals{Users: []string{bob}},
+				Reset:   Principals{Guilds: []string{guild}},
+				Approve: base.Approve,
+				Admin:   base.Admin,
+			},
+		},
+		{
+			name: "replaces a level instead of adding to it",
+			over: ACL{Approve: Principals{Roles: []string{mods}}},
+			want: ACL{Chat: base.Chat, Approve: Principals{Roles: []string{mods}}, Admin: base.Admin},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := base.Merge(tt.over); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge(%+v)\n got %+v\nwant %+v", tt.over, got, tt.want)
+			}
+		})
+	}
+	// a channel cannot open up admin by leaving it empty
+	if (ACL{}).Merge(ACL{Chat: Principals{Users: []string{bob}}}).Allows(ACLAdmin, bob, guild, nil) {
+		t.Errorf("merged chat entry granted admin")
+	}
+}
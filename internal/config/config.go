@@ -2,17 +2,29 @@ package config
 
 import (
 	"errors"
-	"fmt"
 	"os"
-
-	"github.com/BurntSushi/toml"
+	"strings"
 )
 
 type Config struct {
-	Discord Discord `toml:"discord"`
+	// Prometheus形式のメトリクスを公開するアドレス（例 "127.0.0.1:9090"。空で無効）
+	MetricsAddr string  `toml:"metrics_addr"`
+	Discord     Discord `toml:"discord"`
 	// チャンネルごとの実行設定
 	Channels []Channel `toml:"channels"`
 	Codex    Codex     `toml:"codex"`
+	// 会話IDなどの永続化先
+	State State `toml:"state"`
+	// トークン使用量の上限（0は無制限）
+	Quota Quota `toml:"quota"`
+	// Discordの添付ファイルの取り込み
+	Attachments Attachments `toml:"attachments"`
+	// 生成物（長い出力、diff、出力ディレクトリのファイル）のアップロード
+	Artifacts Artifacts `toml:"artifacts"`
+	// 操作できるユーザー/ロール/ギルド（chat/reset は未指定で全員、approve/admin は未指定で誰もできない）
+	ACL ACL `toml:"acl"`
+	// ログの出力形式とレベル
+	Log Log `toml:"log"`
 }
 
 type Discord struct {
@@ -24,18 +36,59 @@ type Discord struct {
 
 type Channel struct {
 	ChannelID string `toml:"channel_id"`
+	// Codexとの接続方式（mcp|interactive|stub、未指定なら [codex].backend、さらに未指定なら mcp）
+	Backend string `toml:"backend,omitempty"`
 	// このチャンネルで実行するコマンドを上書き（未指定なら [codex].command、さらに未指定なら内蔵デフォルト）
+	// backend=interactive では対話モードのCodexを起動するコマンド（未指定なら codex -a never --sandbox workspace-write）
 	Command string `toml:"command,omitempty"`
 	// 作業ディレクトリ（ローカル）。指定すると "cd <dir> && <command>" で実行
 	Workdir string `toml:"workdir,omitempty"`
 	// 実行時に設定する環境変数。例: env = { OPENAI_API_KEY = "..." }
 	Env map[string]string `toml:"env,omitempty"`
+	// コマンド実行/パッチ適用の承認方針（untrusted|on-failure|on-request|never、未指定なら [codex] の値、さらに未指定なら never）
+	ApprovalPolicy string `toml:"approval_policy,omitempty"`
+	// サンドボックス（read-only|workspace-write|danger-full-access、未指定なら [codex] の値、さらに未指定なら workspace-write）
+	Sandbox string `toml:"sandbox,omitempty"`
+	// 新規会話で使うモデル（未指定なら [codex] の値、さらに未指定ならCodexの既定）
+	Model string `toml:"model,omitempty"`
+	// Codexの config.toml のプロファイル名
+	Profile string `toml:"profile,omitempty"`
+	// Codexの既定の指示文を置き換える指示文
+	BaseInstructions string `toml:"base_instructions,omitempty"`
+	// Codexの設定の上書き（config.toml のキー → 値）。[codex].config とキー単位で合成
+	CodexConfig map[string]any `toml:"config,omitempty"`
+	// true ならトップレベルの投稿ごとにスレッドを作り、スレッド単位で会話する
+	Threads bool `toml:"threads,omitempty"`
+	// ツールイベントの表示切り替え（exec, patch, mcp, web_search, diff, plan）。未指定は表示
+	// 例: events = { web_search = false, diff = false }
+	Events map[string]bool `toml:"events,omitempty"`
+	// このチャンネル用のアクセス制御（指定したレベルだけ [acl] を上書き）
+	ACL ACL `toml:"acl,omitempty"`
+	// このチャンネル用のトークン上限（[quota] の値を上書き。0は上書きしない）
+	Quota Quota `toml:"quota,omitempty"`
+	// スレッドモードで会話がスレッドの場合の親チャンネルID（実行時にBotが設定）
+	ParentID string `toml:"-"`
+}
+
+// EventEnabled reports whether events of the category should be shown.
+func (c Channel) EventEnabled(category string) bool {
+	v, ok := c.Events[category]
+	return !ok || v
 }
 
+// Backends a channel can run on.
+const (
+	BackendMCP         = "mcp"
+	BackendInteractive = "interactive"
+	BackendStub        = "stub"
+)
+
 type Codex struct {
-	// インタラクティブ起動に使うコマンド（空なら既定: codex -a never --sandbox workspace-write --color never）
+	// MCPサーバーの起動コマンド（空なら既定: codex mcp）
 	Command string `toml:"command"`
-	// interactiveモード用: セッションJSONLのルートディレクトリを上書き（未指定なら $HOME/.codex/sessions）
+	// チャンネルで未指定のときの接続方式（mcp|interactive|stub、未指定なら mcp）
+	Backend string `toml:"backend"`
+	// backend=interactive 用: セッションJSONLのルートディレクトリを上書き（未指定なら $HOME/.codex/sessions）
 	SessionRoot string `toml:"session_root"`
 	// 1リクエストのタイムアウト（秒）
 	TimeoutSeconds int `toml:"timeout_seconds"`
@@ -45,32 +98,308 @@ type Codex struct {
 	IdleSeconds int `toml:"idle_seconds"`
 	// 新規会話の先頭に付加する指示文（任意）
 	Preamble string `toml:"preamble"`
+	// 承認リクエストの待ち時間（秒）。経過すると拒否扱い（0以下で既定300）
+	ApprovalTimeoutSeconds int `toml:"approval_timeout_seconds"`
+	// 以下はチャンネルで未指定のときの既定値（新規会話の開始時に渡す）
+	ApprovalPolicy   string         `toml:"approval_policy"`
+	Sandbox          string         `toml:"sandbox"`
+	Model            string         `toml:"model"`
+	Profile          string         `toml:"profile"`
+	BaseInstructions string         `toml:"base_instructions"`
+	Config           map[string]any `toml:"config"`
+}
+
+// BackendFor is the backend the channel runs on.
+func (c Codex) BackendFor(ch Channel) string {
+	if b := strings.TrimSpace(ch.Backend); b != "" {
+		return b
+	}
+	if b := strings.TrimSpace(c.Backend); b != "" {
+		return b
+	}
+	return BackendMCP
+}
+
+// Resolve fills the conversation settings ch leaves unset from the [codex]
+// defaults. Config overrides are merged key by key, the channel winning.
+func (c Codex) Resolve(ch Channel) Channel {
+	pick := func(v, def, builtin string) string {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+		if def = strings.TrimSpace(def); def != "" {
+			return def
+		}
+		return builtin
+	}
+	ch.ApprovalPolicy = pick(ch.ApprovalPolicy, c.ApprovalPolicy, "never")
+	ch.Sandbox = pick(ch.Sandbox, c.Sandbox, "workspace-write")
+	ch.Model = pick(ch.Model, c.Model, "")
+	ch.Profile = pick(ch.Profile, c.Profile, "")
+	ch.BaseInstructions = pick(ch.BaseInstructions, c.BaseInstructions, "")
+	if len(c.Config) > 0 {
+		merged := make(map[string]any, len(c.Config)+len(ch.CodexConfig))
+		for k, v := range c.Config {
+			merged[k] = v
+		}
+		for k, v := range ch.CodexConfig {
+			merged[k] = v
+		}
+		ch.CodexConfig = merged
+	}
+	return ch
+}
+
+// Quota limits token usage per Discord user and per channel. Zero means no limit.
+type Quota struct {
+	UserDailyTokens      int64 `toml:"user_daily_tokens,omitempty"`
+	UserMonthlyTokens    int64 `toml:"user_monthly_tokens,omitempty"`
+	ChannelDailyTokens   int64 `toml:"channel_daily_tokens,omitempty"`
+	ChannelMonthlyTokens int64 `toml:"channel_monthly_tokens,omitempty"`
+}
+
+// Merge returns q with the non-zero limits of over applied.
+func (q Quota) Merge(over Quota) Quota {
+	if over.UserDailyTokens != 0 {
+		q.UserDailyTokens = over.UserDailyTokens
+	}
+	if over.UserMonthlyTokens != 0 {
+		q.UserMonthlyTokens = over.UserMonthlyTokens
+	}
+	if over.ChannelDailyTokens != 0 {
+		q.ChannelDailyTokens = over.ChannelDailyTokens
+	}
+	if over.ChannelMonthlyTokens != 0 {
+		q.ChannelMonthlyTokens = over.ChannelMonthlyTokens
+	}
+	return q
+}
+
+// Attachments controls how Discord attachments are handed to Codex. Files are
+// saved under ScratchDir (relative to the channel workdir) and referenced from
+// the prompt.
+type Attachments struct {
+	// 無効化する場合は true
+	Disabled bool `toml:"disabled,omitempty"`
+	// 1ファイルの上限バイト数（既定 8MiB）
+	MaxBytes int64 `toml:"max_bytes,omitempty"`
+	// 1メッセージで取り込む最大数（既定 5）
+	MaxFiles int `toml:"max_files,omitempty"`
+	// 画像として扱うMIMEタイプ（"image/*" のようなワイルドカード可）
+	ImageTypes []string `toml:"image_types,omitempty"`
+	// テキストとして扱うMIMEタイプ
+	TextTypes []string `toml:"text_types,omitempty"`
+	// 保存先（workdir からの相対、または絶対パス。既定 .discodex/attachments）
+	ScratchDir string `toml:"scratch_dir,omitempty"`
+}
+
+// WithDefaults fills unset limits and type lists.
+func (a Attachments) WithDefaults() Attachments {
+	if a.MaxBytes <= 0 {
+		a.MaxBytes = 8 << 20
+	}
+	if a.MaxFiles <= 0 {
+		a.MaxFiles = 5
+	}
+	if len(a.ImageTypes) == 0 {
+		a.ImageTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+	}
+	if len(a.TextTypes) == 0 {
+		a.TextTypes = []string{"text/*", "application/json", "application/xml", "application/x-yaml", "application/yaml", "application/toml", "application/x-sh", "application/javascript", "application/x-patch", "application/x-diff"}
+	}
+	if a.ScratchDir == "" {
+		a.ScratchDir = ".discodex/attachments"
+	}
+	return a
+}
+
+// Artifacts controls files uploaded back to Discord: long outputs as
+// .txt/.diff, long final replies as reply.txt, the turn diff as changes.patch
+// and files written under OutputDir.
+type Artifacts struct {
+	// 無効化する場合は true
+	Disabled bool `toml:"disabled,omitempty"`
+	// アップロードする1ファイルの上限バイト数（既定 8MiB）
+	MaxBytes int64 `toml:"max_bytes,omitempty"`
+	// 1ターンでアップロードする出力ファイルの最大数（既定 10）
+	MaxFiles int `toml:"max_files,omitempty"`
+	// ターン中に作成/更新されたファイルをアップロードするディレクトリ（workdir からの相対、または絶対パス。空で無効）
+	OutputDir string `toml:"output_dir,omitempty"`
+	// 最終応答がこの数のメッセージを超えたら全文を reply.txt でも添付（既定 4）
+	ReplyChunks int `toml:"reply_chunks,omitempty"`
 }
 
+// WithDefaults fills unset limits.
+func (a Artifacts) WithDefaults() Artifacts {
+	if a.MaxBytes <= 0 {
+		a.MaxBytes = 8 << 20
+	}
+	if a.MaxFiles <= 0 {
+		a.MaxFiles = 10
+	}
+	if a.ReplyChunks <= 0 {
+		a.ReplyChunks = 4
+	}
+	return a
+}
+
+// ACL permission levels.
+const (
+	ACLChat    = "chat"
+	ACLReset   = "reset"
+	ACLApprove = "approve"
+	ACLAdmin   = "admin"
+)
+
+// ACL lists who may do what. An empty chat level allows everyone and an
+// empty reset level falls back to chat; approve and admin only allow the
+// listed principals. Admins pass every level.
+type ACL struct {
+	// プロンプト送信、自分のプロンプトのキャンセル、status/usage
+	Chat Principals `toml:"chat,omitempty"`
+	// 会話のリセット、他人のプロンプトのキャンセル（未指定は chat と同じ）
+	Reset Principals `toml:"reset,omitempty"`
+	// コマンド実行/パッチ適用の承認
+	Approve Principals `toml:"approve,omitempty"`
+	// /codex model, /codex cwd などの設定変更
+	Admin Principals `toml:"admin,omitempty"`
+}
+
+// Principals matches Discord users, roles and guilds; any match allows.
+type Principals struct {
+	Users  []string `toml:"users,omitempty"`
+	Roles  []string `toml:"roles,omitempty"`
+	Guilds []string `toml:"guilds,omitempty"`
+}
+
+// Empty reports whether no principal is listed.
+func (p Principals) Empty() bool {
+	return len(p.Users) == 0 && len(p.Roles) == 0 && len(p.Guilds) == 0
+}
+
+// Match reports whether the user, one of its roles or its guild is listed.
+func (p Principals) Match(userID, guildID string, roles []string) bool {
+	for _, u := range p.Users {
+		if u == userID {
+			return true
+		}
+	}
+	for _, g := range p.Guilds {
+		if guildID != "" && g == guildID {
+			return true
+		}
+	}
+	for _, r := range p.Roles {
+		for _, have := range roles {
+			if r == have {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Merge returns a with the non-empty levels of over applied.
+func (a ACL) Merge(over ACL) ACL {
+	if !over.Chat.Empty() {
+		a.Chat = over.Chat
+	}
+	if !over.Reset.Empty() {
+		a.Reset = over.Reset
+	}
+	if !over.Approve.Empty() {
+		a.Approve = over.Approve
+	}
+	if !over.Admin.Empty() {
+		a.Admin = over.Admin
+	}
+	return a
+}
+
+// Allows reports whether the user may act at level.
+func (a ACL) Allows(level, userID, guildID string, roles []string) bool {
+	if !a.Admin.Empty() && a.Admin.Match(userID, guildID, roles) {
+		return true
+	}
+	switch level {
+	case ACLApprove:
+		// approving runs commands on the host; nobody without an entry
+		return a.Approve.Match(userID, guildID, roles)
+	case ACLAdmin:
+		// /codex cwd can point Codex at any directory
+		return false
+	case ACLReset:
+		if !a.Reset.Empty() {
+			return a.Reset.Match(userID, guildID, roles)
+		}
+	}
+	return a.Chat.Empty() || a.Chat.Match(userID, guildID, roles)
+}
+
+type State struct {
+	// 保存方式: file（既定。JSONファイル）| memory（永続化しない）
+	Driver string `toml:"driver"`
+	// driver=file の保存先（未指定なら discodex-state.json）
+	Path string `toml:"path"`
+}
+
+type Log struct {
+	// debug | info（既定）| warn | error。env DISCODEX_LOG_LEVEL が優先
+	Level string `toml:"level"`
+	// text（既定）| json。env DISCODEX_LOG_FORMAT が優先
+	Format string `toml:"format"`
+}
+
+// Load reads the file strictly: unknown keys and invalid values are errors
+// (see Check for the full list, warnings included). Secret references are
+// resolved.
 func Load(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	c, issues, err := check(path, true)
 	if err != nil {
 		return nil, err
 	}
-	var c Config
-	if _, err := toml.Decode(string(data), &c); err != nil {
-		return nil, err
-	}
-	// 簡易バリデーション
-	for i, ch := range c.Channels {
-		if ch.ChannelID == "" {
-			return nil, fmt.Errorf("channels[%d].channel_id is empty", i)
+	for _, is := range issues {
+		if !is.Warning {
+			return nil, &ValidationError{Path: path, Issues: issues}
 		}
 	}
-	return &c, nil
+	return c, nil
 }
 
-func LoadDefault() (*Config, error) {
-	path := os.Getenv("DISCODEX_CONFIG")
-	if path == "" {
-		path = "discodex.toml"
+func validApprovalPolicy(s string) bool {
+	switch s {
+	case "", "untrusted", "on-failure", "on-request", "never":
+		return true
 	}
-	c, err := Load(path)
+	return false
+}
+
+func validBackend(s string) bool {
+	switch s {
+	case "", BackendMCP, BackendInteractive, BackendStub:
+		return true
+	}
+	return false
+}
+
+func validSandbox(s string) bool {
+	switch s {
+	case "", "read-only", "workspace-write", "danger-full-access":
+		return true
+	}
+	return false
+}
+
+// Path is the configuration file: $DISCODEX_CONFIG or discodex.toml.
+func Path() string {
+	if path := os.Getenv("DISCODEX_CONFIG"); path != "" {
+		return path
+	}
+	return "discodex.toml"
+}
+
+func LoadDefault() (*Config, error) {
+	c, err := Load(Path())
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// locator maps setting paths to the lines that define them. The TOML decoder
+// does not expose key positions, so the file text is scanned: table headers,
+// key/value lines and the keys of inline tables. Paths carry array-of-tables
+// indices ("channels[1].workdir").
+type locator struct {
+	// indexed path -> first line
+	lines map[string]int
+	// path without indices -> every line, in file order
+	plain map[string][]int
+}
+
+func locate(src string) *locator {
+	l := &locator{lines: map[string]int{}, plain: map[string][]int{}}
+	arrays := map[string]int{}
+	prefix, plainPrefix := "", ""
+	// open multi-line string delimiter, and bracket depth of a multi-line value
+	inString, depth := "", 0
+	for n, raw := range strings.Split(src, "\n") {
+		ln := n + 1
+		line := strings.TrimSpace(raw)
+		if inString != "" {
+			if strings.Count(line, inString)%2 == 1 {
+				inString = ""
+			}
+			continue
+		}
+		if depth > 0 {
+			depth = max(depth+bracketDepth(line), 0)
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if strings.HasPrefix(line, "[[") {
+			name := keyPath(strings.TrimSuffix(strings.TrimSpace(strings.SplitN(line[2:], "]]", 2)[0]), "]"))
+			idx, ok := arrays[strings.Join(name, ".")]
+			if ok {
+				idx++
+			}
+			arrays[strings.Join(name, ".")] = idx
+			prefix, plainPrefix = indexedPath(arrays, name), strings.Join(name, ".")
+			l.add(prefix, plainPrefix, ln)
+			continue
+		}
+		if line[0] == '[' {
+			name := keyPath(strings.SplitN(line[1:], "]", 2)[0])
+			prefix, plainPrefix = indexedPath(arrays, name), strings.Join(name, ".")
+			l.add(prefix, plainPrefix, ln)
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.Join(keyPath(line[:eq]), ".")
+		path, plain := join(prefix, key), join(plainPrefix, key)
+		l.add(path, plain, ln)
+		value := strings.TrimSpace(line[eq+1:])
+		for _, d := range []string{`"""`, `'''`} {
+			if strings.Count(value, d)%2 == 1 {
+				inString = d
+			}
+		}
+		if strings.HasPrefix(value, "{") {
+			l.inline(value, path, plain, ln)
+		}
+		depth = max(bracketDepth(value), 0)
+	}
+	return l
+}
+
+func (l *locator) add(path, plain string, ln int) {
+	if _, ok := l.lines[path]; !ok {
+		l.lines[path] = ln
+	}
+	l.plain[plain] = append(l.plain[plain], ln)
+}
+
+// inline records the keys of an inline table value, recursing into nested
+// inline tables.
+func (l *locator) inline(value, path, plain string, ln int) {
+	type frame struct{ path, plain string }
+	stack := []frame{}
+	cur := frame{path, plain}
+	start := -1
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\'':
+			if end := strings.IndexByte(value[i+1:], c); end >= 0 {
+				i += end + 1
+			}
+		case '{':
+			stack = append(stack, cur)
+			start = i + 1
+		case '}':
+			if len(stack) == 0 {
+				return
+			}
+			cur = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case ',':
+			start = i + 1
+		case '=':
+			if start < 0 {
+				continue
+			}
+			key := strings.Join(keyPath(value[start:i]), ".")
+			start = -1
+			if key == "" {
+				continue
+			}
+			p, pl := join(stack[len(stack)-1].path, key), join(stack[len(stack)-1].plain, key)
+			l.add(p, pl, ln)
+			if rest := strings.TrimSpace(value[i+1:]); strings.HasPrefix(rest, "{") {
+				cur = frame{p, pl}
+			}
+		case '[':
+			// skip array values so their elements are not taken for keys
+			if end := strings.IndexByte(value[i:], ']'); end >= 0 {
+				i += end
+			}
+		}
+	}
+}
+
+// line is the line of key, or of its closest enclosing table.
+func (l *locator) line(key string) int {
+	for key != "" {
+		if ln, ok := l.lines[key]; ok {
+			return ln
+		}
+		i := strings.LastIndexAny(key, ".[")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return 0
+}
+
+// all returns every line defining the key, ignoring array indices.
+func (l *locator) all(key string) []int {
+	return l.plain[key]
+}
+
+// keyPath splits a dotted TOML key, unquoting its parts.
+func keyPath(s string) []string {
+	var parts []string
+	for _, p := range strings.Split(strings.TrimSpace(s), ".") {
+		p = strings.TrimSpace(p)
+		if u, err := strconv.Unquote(p); err == nil {
+			p = u
+		} else {
+			p = strings.Trim(p, "'")
+		}
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+// indexedPath adds the current index of each enclosing array of tables.
+func indexedPath(arrays map[string]int, name []string) string {
+	var sb strings.Builder
+	for i, part := range name {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(part)
+		if idx, ok := arrays[strings.Join(name[:i+1], ".")]; ok {
+			sb.WriteString("[" + strconv.Itoa(idx) + "]")
+		}
+	}
+	return sb.String()
+}
+
+func join(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// bracketDepth is the change in [ ] nesting over s, ignoring strings and
+// comments.
+func bracketDepth(s string) int {
+	d := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\'':
+			if end := strings.IndexByte(s[i+1:], c); end >= 0 {
+				i += end + 1
+			}
+		case '#':
+			return d
+		case '[':
+			d++
+		case ']':
+			d--
+		}
+	}
+	return d
+}
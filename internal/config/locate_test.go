@@ -0,0 +1,95 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLocate(t *testing.T) {
+	src := `# comment
+log_level = "info"
+discord.bot_token = "x"
+
+[codex]
+"session_root" = "/tmp/s"
+config = { model_reasoning_effort = "high", tools = { web_search = true } }
+
+[[channels]]
+id = "1"
+workdir = "/a"
+base_instructions = """
+key = "not a key"
+"""
+events = [
+  "exec",
+  "diff",
+]
+
+[[channels]]
+id = "2"
+quota.daily_tokens = 10
+env = { A = "1", 'B' = "[x]" }
+
+[state]
+driver = "json"
+`
+	l := locate(src)
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"log_level", 2},
+		{"discord.bot_token", 3},
+		{"discord", 0},
+		{"codex", 5},
+		{"codex.session_root", 6},
+		{"codex.config", 7},
+		{"codex.config.model_reasoning_effort", 7},
+		{"codex.config.tools.web_search", 7},
+		{"channels[0]", 9},
+		{"channels[0].id", 10},
+		{"channels[0].workdir", 11},
+		{"channels[0].base_instructions", 12},
+		{"channels[0].events", 15},
+		{"channels[1]", 20},
+		{"channels[1].id", 21},
+		{"channels[1].quota.daily_tokens", 22},
+		{"channels[1].env.A", 23},
+		{"channels[1].env.B", 23},
+		{"state.driver", 26},
+		// unknown keys fall back to the enclosing table
+		{"channels[1].typo", 20},
+		{"state.missing", 25},
+		{"key", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := l.line(tt.key); got != tt.want {
+				t.Errorf("line(%q) = %d, want %d", tt.key, got, tt.want)
+			}
+		})
+	}
+	if got, want := l.all("channels.id"), []int{10, 21}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all(channels.id) = %v, want %v", got, want)
+	}
+	if got := l.all("channels.key"); got != nil {
+		t.Errorf("all(channels.key) = %v, want none (inside a multi-line string)", got)
+	}
+}
+
+func TestValidatorDedupe(t *testing.T) {
+	v := &validator{loc: locate("a = 1\nb = 2\n"), seen: map[issueKey]bool{}}
+	v.errorf("a", "bad %d", 1)
+	v.errorf("a", "bad %d", 1)
+	v.warnf("a", "bad %d", 1)
+	v.errorf("a", "bad %d", 2)
+	v.errorf("b", "bad %d", 1)
+	want := []Issue{
+		{Key: "a", Line: 1, Msg: "bad 1"},
+		{Key: "a", Line: 1, Msg: "bad 2"},
+		{Key: "b", Line: 2, Msg: "bad 1"},
+	}
+	if !reflect.DeepEqual(v.issues, want) {
+		t.Errorf("issues\n got %+v\nwant %+v", v.issues, want)
+	}
+}
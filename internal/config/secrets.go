@@ -0,0 +1,158 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretCommandTimeout bounds a cmd: secret reference.
+const secretCommandTimeout = 10 * time.Second
+
+var envRef = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\}$`)
+
+var (
+	secretMu sync.RWMutex
+	// resolved secret values, longest first so overlapping values redact fully
+	secretValues []string
+)
+
+// resolveSecret expands a secret reference: "${VAR}" (environment variable),
+// "file:/path" (file contents) or "cmd:command" (the command's output), with
+// surrounding whitespace trimmed. Other values are returned as is. cache maps
+// references already resolved by the same Load, so a reference shared by
+// several channels runs its command once; every Load resolves afresh and picks
+// up rotated secrets. Resolved values are registered for Redact.
+func resolveSecret(v string, cache map[string]string) (string, bool, error) {
+	if !isSecretRef(v) {
+		return v, false, nil
+	}
+	if out, ok := cache[v]; ok {
+		return out, true, nil
+	}
+	var out string
+	switch {
+	case envRef.MatchString(v):
+		name := envRef.FindStringSubmatch(v)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return "", true, fmt.Errorf("環境変数 %s が未設定", name)
+		}
+		out = val
+	case strings.HasPrefix(v, "file:"):
+		data, err := os.ReadFile(strings.TrimSpace(strings.TrimPrefix(v, "file:")))
+		if err != nil {
+			return "", true, fmt.Errorf("ファイルを読めない: %w", err)
+		}
+		out = string(data)
+	case strings.HasPrefix(v, "cmd:"):
+		s, err := secretCommand(strings.TrimSpace(strings.TrimPrefix(v, "cmd:")))
+		if err != nil {
+			return "", true, err
+		}
+		out = s
+	default:
+		return v, false, nil
+	}
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return "", true, fmt.Errorf("値が空")
+	}
+	registerSecret(out)
+	cache[v] = out
+	return out, true, nil
+}
+
+func isSecretRef(v string) bool {
+	return envRef.MatchString(v) || strings.HasPrefix(v, "file:") || strings.HasPrefix(v, "cmd:")
+}
+
+// checkSecret verifies a reference without resolving it: the variable is set,
+// the file can be opened. It returns the command line of a cmd: reference,
+// which is not run.
+func checkSecret(v string) (cmdLine string, err error) {
+	switch {
+	case envRef.MatchString(v):
+		name := envRef.FindStringSubmatch(v)[1]
+		if _, ok := os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("環境変数 %s が未設定", name)
+		}
+	case strings.HasPrefix(v, "file:"):
+		f, err := os.Open(strings.TrimSpace(strings.TrimPrefix(v, "file:")))
+		if err != nil {
+			return "", fmt.Errorf("ファイルを読めない: %w", err)
+		}
+		f.Close()
+	case strings.HasPrefix(v, "cmd:"):
+		line := strings.TrimSpace(strings.TrimPrefix(v, "cmd:"))
+		if line == "" {
+			return "", fmt.Errorf("コマンドが空")
+		}
+		return line, nil
+	}
+	return "", nil
+}
+
+func secretCommand(line string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "powershell", "-NoLogo", "-Command", line)
+	} else {
+		cmd = exec.CommandContext(ctx, "bash", "-lc", line)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// the command's stderr may help, but never its stdout
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		if msg != "" {
+			return "", fmt.Errorf("コマンドが失敗: %v: %s", err, msg)
+		}
+		return "", fmt.Errorf("コマンドが失敗: %v", err)
+	}
+	return string(out), nil
+}
+
+// registerSecret adds a value that Redact must hide. Very short values are
+// ignored; masking them would garble unrelated log text.
+func registerSecret(v string) {
+	if len(v) < 4 {
+		return
+	}
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	for _, s := range secretValues {
+		if s == v {
+			return
+		}
+	}
+	secretValues = append(secretValues, v)
+	sort.Slice(secretValues, func(i, j int) bool { return len(secretValues[i]) > len(secretValues[j]) })
+}
+
+// Redact replaces every known secret in s with "***". Use it for anything
+// logged that may carry configuration values.
+func Redact(s string) string {
+	secretMu.RLock()
+	defer secretMu.RUnlock()
+	for _, v := range secretValues {
+		if strings.Contains(s, v) {
+			s = strings.ReplaceAll(s, v, "***")
+		}
+	}
+	return s
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretRegistersReferencesOnly(t *testing.T) {
+	t.Setenv("DISCODEX_TEST_SECRET", "s3cr3t-from-env")
+	v := &validator{loc: locate(""), seen: map[issueKey]bool{}, resolve: true, resolved: map[string]string{}}
+	v.secret("channels[0].env.RUST_LOG", "debug-plain")
+	v.secret("channels[0].env.API_KEY", "${DISCODEX_TEST_SECRET}")
+	v.secret("discord.bot_token", "plain-bot-token")
+	if len(v.issues) > 0 {
+		t.Fatalf("issues: %v", v.issues)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"level=debug-plain", "level=debug-plain"},
+		{"key=s3cr3t-from-env", "key=***"},
+		{"token=plain-bot-token", "token=***"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSecretPicksUpRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("first-value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ref := "file:" + path
+	load := map[string]string{}
+	if got, _, err := resolveSecret(ref, load); err != nil || got != "first-value" {
+		t.Fatalf("first load = %q, %v", got, err)
+	}
+	if err := os.WriteFile(path, []byte("second-value\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _ := resolveSecret(ref, load); got != "first-value" {
+		t.Errorf("same load = %q, want the cached first-value", got)
+	}
+	if got, _, _ := resolveSecret(ref, map[string]string{}); got != "second-value" {
+		t.Errorf("next load = %q, want second-value", got)
+	}
+}
@@ -0,0 +1,494 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Issue is one problem found in the configuration file.
+type Issue struct {
+	// Key is the setting, e.g. "channels[1].workdir" (empty for file-level issues)
+	Key string
+	// Line is the 1-based line in the file, 0 when unknown
+	Line int
+	Msg  string
+	// Warning issues do not prevent loading.
+	Warning bool
+}
+
+func (i Issue) String() string {
+	s := i.Msg
+	if i.Key != "" {
+		s = i.Key + ": " + s
+	}
+	if i.Warning {
+		s = "warning: " + s
+	}
+	return s
+}
+
+// ValidationError is returned by Load when the file has error-level issues.
+type ValidationError struct {
+	Path   string
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	n := 0
+	for _, is := range e.Issues {
+		if is.Warning {
+			continue
+		}
+		if n > 0 {
+			sb.WriteString("; ")
+		}
+		n++
+		if is.Line > 0 {
+			fmt.Fprintf(&sb, "%s:%d: ", e.Path, is.Line)
+		}
+		sb.WriteString(is.String())
+	}
+	return sb.String()
+}
+
+var snowflakeID = regexp.MustCompile(`^[0-9]{17,20}$`)
+
+// eventCategories are the valid keys of [[channels]].events.
+var eventCategories = []string{"exec", "patch", "mcp", "web_search", "diff", "plan"}
+
+// Check decodes the file strictly and validates every setting. It returns the
+// decoded config (nil when the file cannot be parsed) and all issues, sorted
+// by line. The error is only for unreadable files. Secret references are only
+// checked for presence (cmd: commands are not run) and left unresolved.
+func Check(path string) (*Config, []Issue, error) {
+	return check(path, false)
+}
+
+// check is Check; with resolve set, secret references are resolved in place.
+func check(path string, resolve bool) (*Config, []Issue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var c Config
+	md, err := toml.Decode(string(data), &c)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return nil, []Issue{{Line: pe.Position.Line, Msg: pe.Message}}, nil
+		}
+		return nil, []Issue{{Msg: err.Error()}}, nil
+	}
+	v := &validator{loc: locate(string(data)), lookups: map[string]error{}, seen: map[issueKey]bool{}, resolve: resolve, resolved: map[string]string{}}
+	v.undecoded(md.Undecoded())
+	v.config(&c)
+	sort.SliceStable(v.issues, func(i, j int) bool {
+		a, b := v.issues[i].Line, v.issues[j].Line
+		return a > 0 && (b == 0 || a < b)
+	})
+	return &c, v.issues, nil
+}
+
+type validator struct {
+	loc    *locator
+	issues []Issue
+	// command word -> lookup result, so shared commands are resolved once
+	lookups map[string]error
+	// resolve secret references (Load) instead of only checking them (Check)
+	resolve bool
+	// reference -> value resolved during this Load
+	resolved map[string]string
+	// issues already reported, so a check reached twice reports once
+	seen map[issueKey]bool
+}
+
+type issueKey struct {
+	key  string
+	line int
+	msg  string
+}
+
+func (v *validator) add(is Issue) {
+	k := issueKey{is.Key, is.Line, is.Msg}
+	if v.seen[k] {
+		return
+	}
+	v.seen[k] = true
+	v.issues = append(v.issues, is)
+}
+
+func (v *validator) errorf(key, format string, args ...any) {
+	v.add(Issue{Key: key, Line: v.loc.line(key), Msg: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(key, format string, args ...any) {
+	v.add(Issue{Key: key, Line: v.loc.line(key), Msg: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// undecoded reports keys that match no setting (typos, removed settings).
+func (v *validator) undecoded(keys []toml.Key) {
+	seen := map[string]bool{}
+	for _, k := range keys {
+		// children of an unknown table are covered by the table itself
+		parent := false
+		for i := 1; i < len(k); i++ {
+			if seen[k[:i].String()] {
+				parent = true
+				break
+			}
+		}
+		name := k.String()
+		if parent || seen[name] {
+			continue
+		}
+		seen[name] = true
+		lines := v.loc.all(name)
+		if len(lines) == 0 {
+			lines = []int{0}
+		}
+		for _, ln := range lines {
+			v.add(Issue{Key: name, Line: ln, Msg: "未知のキー（綴りを確認）"})
+		}
+	}
+}
+
+func (v *validator) config(c *Config) {
+	v.secrets(c)
+	if strings.TrimSpace(c.Discord.BotToken) == "" {
+		v.errorf("discord.bot_token", "未設定")
+	}
+	v.snowflake("discord.guild_id", c.Discord.GuildID)
+	v.snowflake("discord.log_channel_id", c.Discord.LogChannelID)
+	if addr := strings.TrimSpace(c.MetricsAddr); addr != "" {
+		if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+			v.errorf("metrics_addr", "%q は host:port の形式でない", addr)
+		}
+	}
+
+	seen := map[string]int{}
+	interactive := c.Codex.BackendFor(Channel{}) == BackendInteractive
+	for i, ch := range c.Channels {
+		key := fmt.Sprintf("channels[%d]", i)
+		switch {
+		case ch.ChannelID == "":
+			v.errorf(key+".channel_id", "未設定")
+		case !snowflakeID.MatchString(ch.ChannelID):
+			v.errorf(key+".channel_id", "DiscordのID（17〜20桁の数字）ではない: %q", ch.ChannelID)
+		default:
+			if j, ok := seen[ch.ChannelID]; ok {
+				v.errorf(key+".channel_id", "channels[%d] と重複: %s", j, ch.ChannelID)
+			}
+			seen[ch.ChannelID] = i
+		}
+		if !validApprovalPolicy(ch.ApprovalPolicy) {
+			v.errorf(key+".approval_policy", "不正な値: %q（untrusted | on-failure | on-request | never）", ch.ApprovalPolicy)
+		}
+		if !validSandbox(ch.Sandbox) {
+			v.errorf(key+".sandbox", "不正な値: %q（read-only | workspace-write | danger-full-access）", ch.Sandbox)
+		}
+		cats := make([]string, 0, len(ch.Events))
+		for cat := range ch.Events {
+			cats = append(cats, cat)
+		}
+		sort.Strings(cats)
+		for _, cat := range cats {
+			if !contains(eventCategories, cat) {
+				v.warnf(key+".events."+cat, "未知のイベント種別（%s）", strings.Join(eventCategories, ", "))
+			}
+		}
+		if !validBackend(ch.Backend) {
+			v.errorf(key+".backend", "不正な値: %q（mcp | interactive | stub）", ch.Backend)
+		}
+		if ch.Workdir != "" {
+			v.workdir(key+".workdir", ch.Workdir)
+		}
+		line := strings.TrimSpace(ch.Command)
+		cmdKey := key + ".command"
+		switch c.Codex.BackendFor(ch) {
+		case BackendMCP:
+			if line == "" {
+				line = strings.TrimSpace(c.Codex.Command)
+				cmdKey = "codex.command"
+			}
+			v.command(cmdKey, line, ch.Workdir, ch.Env)
+		case BackendInteractive:
+			interactive = true
+			v.command(cmdKey, line, ch.Workdir, ch.Env)
+			v.interactive(key, c.Codex, ch)
+		}
+		v.acl(key+".acl", ch.ACL)
+		if acl := c.ACL.Merge(ch.ACL); c.Codex.Resolve(ch).ApprovalPolicy != "never" && acl.Approve.Empty() && acl.Admin.Empty() {
+			v.warnf(key+".approval_policy", "acl.approve / acl.admin が未設定のため、承認リクエストを誰も承認できない")
+		}
+		v.quota(key+".quota", ch.Quota)
+	}
+	if len(c.Channels) == 0 {
+		v.warnf("channels", "紐付けチャンネルが無い（メンションでの単発実行のみ）")
+		if c.Codex.BackendFor(Channel{}) == BackendMCP {
+			v.command("codex.command", strings.TrimSpace(c.Codex.Command), "", nil)
+		}
+	}
+	if !validBackend(c.Codex.Backend) {
+		v.errorf("codex.backend", "不正な値: %q（mcp | interactive | stub）", c.Codex.Backend)
+	}
+
+	if !validApprovalPolicy(c.Codex.ApprovalPolicy) {
+		v.errorf("codex.approval_policy", "不正な値: %q（untrusted | on-failure | on-request | never）", c.Codex.ApprovalPolicy)
+	}
+	if !validSandbox(c.Codex.Sandbox) {
+		v.errorf("codex.sandbox", "不正な値: %q（read-only | workspace-write | danger-full-access）", c.Codex.Sandbox)
+	}
+	if c.Codex.SessionRoot != "" {
+		if !interactive {
+			v.warnf("codex.session_root", "backend = \"interactive\" のチャンネルが無いため使われない")
+		} else if !isDir(c.Codex.SessionRoot) {
+			v.errorf("codex.session_root", "ディレクトリが存在しない: %s", c.Codex.SessionRoot)
+		}
+	}
+	if c.Codex.TimeoutSeconds < 0 {
+		v.errorf("codex.timeout_seconds", "負の値: %d", c.Codex.TimeoutSeconds)
+	}
+
+	switch c.State.Driver {
+	case "", "file", "memory":
+	default:
+		v.errorf("state.driver", "不正な値: %q（file | memory）", c.State.Driver)
+	}
+	if c.State.Path != "" && c.State.Driver != "memory" {
+		if dir := filepath.Dir(c.State.Path); !isDir(dir) {
+			v.errorf("state.path", "保存先のディレクトリが存在しない: %s", dir)
+		}
+	}
+
+	switch strings.ToLower(c.Log.Level) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		v.errorf("log.level", "不正な値: %q（debug | info | warn | error）", c.Log.Level)
+	}
+	switch strings.ToLower(c.Log.Format) {
+	case "", "text", "json":
+	default:
+		v.errorf("log.format", "不正な値: %q（text | json）", c.Log.Format)
+	}
+
+	v.quota("quota", c.Quota)
+	v.acl("acl", c.ACL)
+	if c.Attachments.MaxBytes < 0 || c.Attachments.MaxFiles < 0 {
+		v.errorf("attachments", "max_bytes / max_files に負の値")
+	}
+	if c.Artifacts.MaxBytes < 0 || c.Artifacts.MaxFiles < 0 || c.Artifacts.ReplyChunks < 0 {
+		v.errorf("artifacts", "max_bytes / max_files / reply_chunks に負の値")
+	}
+}
+
+// secrets handles the ${VAR} / file: / cmd: references in bot_token and the
+// channel env values: resolved in place when loading, only checked otherwise.
+// Resolved references and the bot token are hidden from logs; plaintext env
+// values (RUST_LOG, PATH, ...) are not, or they would garble unrelated lines.
+func (v *validator) secrets(c *Config) {
+	c.Discord.BotToken = v.secret("discord.bot_token", c.Discord.BotToken)
+	for i := range c.Channels {
+		env := c.Channels[i].Env
+		keys := make([]string, 0, len(env))
+		for k := range env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			env[k] = v.secret(fmt.Sprintf("channels[%d].env.%s", i, k), env[k])
+		}
+	}
+}
+
+func (v *validator) secret(key, val string) string {
+	if !v.resolve {
+		line, err := checkSecret(val)
+		if err != nil {
+			v.errorf(key, "%v", err)
+		} else if line != "" {
+			v.command(key, line, "", nil)
+		}
+		return val
+	}
+	out, isRef, err := resolveSecret(val, v.resolved)
+	if err != nil {
+		v.errorf(key, "%v", err)
+		return val
+	}
+	// resolveSecret registers resolved references itself
+	if !isRef && key == "discord.bot_token" {
+		registerSecret(out)
+	}
+	return out
+}
+
+// interactive checks the settings the interactive backend cannot honor: it
+// cannot answer approvals, passes the conversation settings as flags of the
+// default command only, and has no way to set base instructions.
+func (v *validator) interactive(key string, codex Codex, ch Channel) {
+	r := codex.Resolve(ch)
+	if r.ApprovalPolicy != "never" {
+		v.errorf(key+".approval_policy", "backend = \"interactive\" では承認に答えられない（never のみ）: %q", r.ApprovalPolicy)
+	}
+	if r.BaseInstructions != "" {
+		v.warnf(key+".base_instructions", "backend = \"interactive\" では使われない")
+	}
+	if strings.TrimSpace(ch.Command) != "" && (r.Sandbox != "workspace-write" || r.Model != "" || r.Profile != "" || len(r.CodexConfig) > 0) {
+		v.warnf(key+".command", "backend = \"interactive\" で command を指定すると sandbox / model / profile / config は渡されない（コマンドに含める）")
+	}
+}
+
+func (v *validator) snowflake(key, id string) {
+	if id != "" && !snowflakeID.MatchString(id) {
+		v.errorf(key, "DiscordのID（17〜20桁の数字）ではない: %q", id)
+	}
+}
+
+func (v *validator) acl(key string, a ACL) {
+	levels := []struct {
+		name string
+		p    Principals
+	}{{ACLChat, a.Chat}, {ACLReset, a.Reset}, {ACLApprove, a.Approve}, {ACLAdmin, a.Admin}}
+	for _, l := range levels {
+		for _, id := range l.p.Users {
+			v.snowflake(key+"."+l.name+".users", id)
+		}
+		for _, id := range l.p.Roles {
+			v.snowflake(key+"."+l.name+".roles", id)
+		}
+		for _, id := range l.p.Guilds {
+			v.snowflake(key+"."+l.name+".guilds", id)
+		}
+	}
+}
+
+func (v *validator) quota(key string, q Quota) {
+	if q.UserDailyTokens < 0 || q.UserMonthlyTokens < 0 || q.ChannelDailyTokens < 0 || q.ChannelMonthlyTokens < 0 {
+		v.errorf(key, "負の上限（0で無制限）")
+	}
+}
+
+// workdir checks that the directory exists and can be listed and entered.
+func (v *validator) workdir(key, dir string) {
+	fi, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		v.errorf(key, "ディレクトリが存在しない: %s", dir)
+		return
+	case err != nil:
+		v.errorf(key, "%v", err)
+		return
+	case !fi.IsDir():
+		v.errorf(key, "ディレクトリではない: %s", dir)
+		return
+	}
+	f, err := os.Open(dir)
+	if err == nil {
+		_, err = f.Readdirnames(1)
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		v.errorf(key, "読み取れない（権限を確認）: %s", dir)
+	}
+}
+
+// command checks that the program the command line starts is found. An empty
+// line means the built-in `codex mcp`.
+func (v *validator) command(key, line, workdir string, env map[string]string) {
+	word := commandWord(line)
+	if line == "" {
+		word = "codex"
+	}
+	if word == "" {
+		return
+	}
+	id := word + "\x00" + workdir + "\x00" + env["PATH"]
+	if _, done := v.lookups[id]; done {
+		// already reported for an earlier channel
+		return
+	}
+	err := lookCommand(word, workdir, env)
+	v.lookups[id] = err
+	if err != nil {
+		v.errorf(key, "コマンドが見つからない: %s", word)
+	}
+}
+
+// commandWord is the program a shell command line runs: the first word after
+// variable assignments and env/exec. Lines starting with shell syntax (cd,
+// subshells, ...) return "".
+func commandWord(line string) string {
+	for _, w := range strings.Fields(line) {
+		switch {
+		case strings.Contains(w, "=") && !strings.HasPrefix(w, "="):
+			continue
+		case w == "env" || w == "exec":
+			continue
+		case strings.ContainsAny(w, "()$`{}&|;<>") || w == "cd" || w == "source" || w == ".":
+			return ""
+		}
+		return strings.Trim(w, `"'`)
+	}
+	return ""
+}
+
+func lookCommand(word, workdir string, env map[string]string) error {
+	if strings.ContainsRune(word, os.PathSeparator) || strings.ContainsRune(word, '/') {
+		if !filepath.IsAbs(word) && workdir != "" {
+			word = filepath.Join(workdir, word)
+		}
+		fi, err := os.Stat(word)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || (runtime.GOOS != "windows" && fi.Mode()&0o111 == 0) {
+			return fmt.Errorf("not executable")
+		}
+		return nil
+	}
+	if p, ok := env["PATH"]; ok {
+		for _, dir := range filepath.SplitList(p) {
+			if fi, err := os.Stat(filepath.Join(dir, word)); err == nil && !fi.IsDir() {
+				return nil
+			}
+		}
+	}
+	if _, err := exec.LookPath(word); err == nil {
+		return nil
+	}
+	if runtime.GOOS == "windows" {
+		return exec.ErrNotFound
+	}
+	// commands run through `bash -lc`, whose login profile may extend PATH
+	return exec.Command("bash", "-lc", "command -v -- "+shellQuote(word)).Run()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func isDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package discordbot
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/bwmarrin/discordgo"
+)
+
+const deniedEmoji = "🚫"
+
+// actor is the Discord user behind a message, reaction or interaction.
+type actor struct {
+	userID  string
+	guildID string
+	roles   []string
+}
+
+// WithACL sets the global access control; channels may override levels.
+func (b *Bot) WithACL(acl config.ACL) *Bot {
+	b.update(func(s *settings) { s.acl = acl })
+	return b
+}
+
+func messageActor(m *discordgo.Message) actor {
+	a := actor{guildID: m.GuildID}
+	if m.Author != nil {
+		a.userID = m.Author.ID
+	}
+	if m.Member != nil {
+		a.roles = m.Member.Roles
+	}
+	return a
+}
+
+func interactionActor(i *discordgo.InteractionCreate) actor {
+	a := actor{userID: interactionUserID(i), guildID: i.GuildID}
+	if i.Member != nil {
+		a.roles = i.Member.Roles
+	}
+	return a
+}
+
+// permit checks the ACL for ch and reports a denial to the log channel.
+func (b *Bot) permit(ch config.Channel, level string, a actor, action string) bool {
+	if b.settings().acl.Merge(ch.ACL).Allows(level, a.userID, a.guildID, a.roles) {
+		return true
+	}
+	slog.Warn("acl: denied", "level", level, logging.KeyUser, a.userID, logging.KeyChannel, ch.ChannelID, "action", action)
+	if logID := b.settings().logChannelID; logID != "" && b.session != nil {
+		b.sendText(logID, fmt.Sprintf("[acl] denied %s: user=%s channel=<#%s> action=%s", level, a.userID, ch.ChannelID, action))
+	}
+	return false
+}
+
+// permitInteraction is permit for slash commands and buttons; denied users get
+// an ephemeral reply.
+func (b *Bot) permitInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, ch config.Channel, level, action string) bool {
+	if b.permit(ch, level, interactionActor(i), action) {
+		return true
+	}
+	respondEphemeral(s, i, "🚫 この操作の権限がない")
+	return false
+}
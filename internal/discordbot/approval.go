@@ -0,0 +1,184 @@
+package discordbot
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/bwmarrin/discordgo"
+)
+
+const approvalPrefix = "approval:"
+
+// RequestApproval posts the exec command or patch with Approve/Deny buttons and
+// blocks until someone clicks or ctx expires (which counts as deny).
+func (b *Bot) RequestApproval(ctx context.Context, req codex.ApprovalRequest) codex.ApprovalDecision {
+	if b.session == nil || req.ChannelID == "" {
+		return codex.DecisionDenied
+	}
+	token := newApprovalToken()
+	ch := make(chan codex.ApprovalDecision, 1)
+	b.mu.Lock()
+	b.approvals[token] = ch
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.approvals, token)
+		b.mu.Unlock()
+	}()
+
+	content := renderApproval(req)
+	var files []*discordgo.File
+	if req.Kind == codex.ApprovalPatch {
+		// the message only shows the start of a large patch
+		files = b.longOutputFile("patch.diff", req.Diff, 1400)
+	}
+	msg, err := b.session.ChannelMessageSendComplex(req.ChannelID, &discordgo.MessageSend{
+		Content: content,
+		Files:   files,
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: "Approve", Style: discordgo.SuccessButton, CustomID: approvalPrefix + token + ":approve"},
+			discordgo.Button{Label: "Deny", Style: discordgo.DangerButton, CustomID: approvalPrefix + token + ":deny"},
+		}}},
+	})
+	if err != nil {
+		b.reportErrorf("approval", err)
+		return codex.DecisionDenied
+	}
+	select {
+	case d := <-ch:
+		return d
+	case <-ctx.Done():
+		// timed out or the turn was cancelled: deny and strip the buttons
+		empty := []discordgo.MessageComponent{}
+		text := content + "\n⌛ タイムアウトにより拒否した"
+		if errors.Is(context.Cause(ctx), codex.ErrCancelled) {
+			text = content + "\n⏹️ ターンがキャンセルされた"
+		}
+		_, _ = b.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+			ID:         msg.ID,
+			Channel:    req.ChannelID,
+			Content:    &text,
+			Components: &empty,
+		})
+		return codex.DecisionDenied
+	}
+}
+
+// handleApprovalClick resolves a pending approval from a button press.
+func (b *Bot) handleApprovalClick(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	rest := strings.TrimPrefix(customID, approvalPrefix)
+	token, action, _ := strings.Cut(rest, ":")
+	conf, _ := b.channel(i.ChannelID)
+	if !b.permitInteraction(s, i, conf, config.ACLApprove, "approval "+action) {
+		return
+	}
+	b.mu.Lock()
+	ch, ok := b.approvals[token]
+	b.mu.Unlock()
+	if !ok {
+		respondEphemeral(s, i, "この承認リクエストは既に終了している")
+		return
+	}
+	decision := codex.DecisionDenied
+	verdict := "❌ 拒否"
+	if action == "approve" {
+		decision = codex.DecisionApproved
+		verdict = "✅ 承認"
+	}
+	select {
+	case ch <- decision:
+	default:
+		respondEphemeral(s, i, "この承認リクエストは既に処理済み")
+		return
+	}
+	content := i.Message.Content + fmt.Sprintf("\n%s: %s", verdict, interactionUserName(i))
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: content, Components: []discordgo.MessageComponent{}},
+	})
+	if err != nil {
+		slog.Debug("approval: respond failed", logging.KeyChannel, i.ChannelID, "error", err)
+	}
+}
+
+func renderApproval(req codex.ApprovalRequest) string {
+	var sb strings.Builder
+	switch req.Kind {
+	case codex.ApprovalExec:
+		sb.WriteString("🔐 **コマンド実行の承認**\n")
+		fmt.Fprintf(&sb, "```sh\n%s\n```", clip(req.Command, 1200))
+		if req.Cwd != "" {
+			fmt.Fprintf(&sb, "\ncwd: `%s`", req.Cwd)
+		}
+	case codex.ApprovalPatch:
+		sb.WriteString("🔐 **パッチ適用の承認**\n")
+		if r := strings.TrimSpace(req.Reason); r != "" {
+			sb.WriteString(clip(r, 200) + "\n")
+		}
+		fmt.Fprintf(&sb, "```diff\n%s\n```", clip(strings.TrimRight(req.Diff, "\n"), 1400))
+	default:
+		sb.WriteString("🔐 **承認リクエスト**\n" + clip(req.Message, 1500))
+	}
+	return sb.String()
+}
+
+// clip shortens s to at most n runes, marking the cut.
+func clip(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+func newApprovalToken() string {
+	var buf [8]byte
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	_ = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
+
+// respondEphemeralFiles is respondEphemeral with attachments.
+func respondEphemeralFiles(s *discordgo.Session, i *discordgo.InteractionCreate, content string, files []*discordgo.File) {
+	_ = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: content, Files: files, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
+
+func interactionUserName(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		if i.Member.Nick != "" {
+			return i.Member.Nick
+		}
+		return i.Member.User.Username
+	}
+	if i.User != nil {
+		return i.User.Username
+	}
+	return "?"
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
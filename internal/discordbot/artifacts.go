@@ -0,0 +1,247 @@
+package discordbot
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/bwmarrin/discordgo"
+)
+
+// turnArtifacts collects what a running turn produced for upload at its end.
+type turnArtifacts struct {
+	ch    config.Channel
+	start time.Time
+	// latest turn_diff
+	diff string
+	// paths Codex patched or mentioned in its reply
+	paths map[string]bool
+}
+
+// inlinePath matches `path/like.this` spans in agent replies.
+var inlinePath = regexp.MustCompile("`([^`\\s]+)`")
+
+// WithArtifacts sets the size caps and output directory for uploads.
+func (b *Bot) WithArtifacts(conf config.Artifacts) *Bot {
+	b.update(func(s *settings) { s.artifacts = conf.WithDefaults() })
+	return b
+}
+
+// beginArtifacts starts collecting for the channel's next turn.
+func (b *Bot) beginArtifacts(ch config.Channel) {
+	if b.settings().artifacts.Disabled {
+		return
+	}
+	b.eventMu.Lock()
+	b.artifacts[ch.ChannelID] = &turnArtifacts{ch: ch, start: time.Now(), paths: map[string]bool{}}
+	b.eventMu.Unlock()
+}
+
+// noteArtifacts records the turn diff and touched paths; callers hold eventMu.
+func (b *Bot) noteArtifacts(channelID string, ev codex.Event) {
+	ta, ok := b.artifacts[channelID]
+	if !ok {
+		return
+	}
+	switch e := ev.(type) {
+	case codex.TurnDiff:
+		ta.diff = e.Diff
+	case codex.PatchBegin:
+		for _, f := range e.Files {
+			ta.paths[f.Path] = true
+			if f.MovePath != "" {
+				ta.paths[f.MovePath] = true
+			}
+		}
+	}
+}
+
+// noteReplyPaths records paths quoted in an agent reply.
+func (b *Bot) noteReplyPaths(channelID, text string) {
+	b.eventMu.Lock()
+	defer b.eventMu.Unlock()
+	ta, ok := b.artifacts[channelID]
+	if !ok {
+		return
+	}
+	for _, m := range inlinePath.FindAllStringSubmatch(text, 50) {
+		ta.paths[m[1]] = true
+	}
+}
+
+// takeArtifacts ends collection for the channel; callers hold eventMu.
+func (b *Bot) takeArtifacts(channelID string) *turnArtifacts {
+	ta := b.artifacts[channelID]
+	delete(b.artifacts, channelID)
+	return ta
+}
+
+// uploadArtifacts posts the turn diff as changes.patch and the files written
+// under output_dir during the turn.
+func (b *Bot) uploadArtifacts(channelID string, ta *turnArtifacts) {
+	conf := b.settings().artifacts
+	var files []*discordgo.File
+	var notes []string
+	if strings.TrimSpace(ta.diff) != "" && ta.ch.EventEnabled(codex.CategoryDiff) {
+		files = append(files, textFile("changes.patch", ta.diff, conf.MaxBytes))
+	}
+	if conf.OutputDir != "" {
+		outFiles, skipped := collectOutputFiles(conf, ta, scratchRoot(b.settings().attachments, ta.ch))
+		notes = append(notes, skipped...)
+		for _, path := range outFiles {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				notes = append(notes, fmt.Sprintf("`%s`: 読み込みに失敗した", filepath.Base(path)))
+				continue
+			}
+			files = append(files, &discordgo.File{Name: filepath.Base(path), Reader: bytes.NewReader(data)})
+		}
+	}
+	if len(files) == 0 && len(notes) == 0 {
+		return
+	}
+	content := "📎 このターンの生成物"
+	if len(notes) > 0 {
+		content += "\n⚠️ アップロードしなかったファイル:\n- " + strings.Join(notes, "\n- ")
+	}
+	// Discord accepts at most 10 files per message
+	for len(files) > 0 || content != "" {
+		n := len(files)
+		if n > 10 {
+			n = 10
+		}
+		_, err := b.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Content: clip(content, messageLimit), Files: files[:n]})
+		if err != nil {
+			b.reportErrorf("artifacts", err)
+			return
+		}
+		files, content = files[n:], ""
+	}
+}
+
+// collectOutputFiles lists regular files under output_dir that were modified
+// during the turn or that Codex patched or mentioned, within the caps. Files
+// under scratch (saved Discord attachments) are left out.
+func collectOutputFiles(conf config.Artifacts, ta *turnArtifacts, scratch string) ([]string, []string) {
+	base := ta.ch.Workdir
+	if base == "" {
+		base, _ = os.Getwd()
+	}
+	root := conf.OutputDir
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(base, root)
+	}
+	seen := map[string]bool{}
+	var found []string
+	add := func(path string) {
+		if rel, err := filepath.Rel(scratch, path); err == nil && !strings.HasPrefix(rel, "..") {
+			return
+		}
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		found = append(found, path)
+	}
+	for p := range ta.paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		p = filepath.Clean(p)
+		if rel, err := filepath.Rel(root, p); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			add(p)
+		}
+	}
+	walked := 0
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if walked++; walked > 5000 {
+			return filepath.SkipAll
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil && !fi.ModTime().Before(ta.start) {
+			add(path)
+		}
+		return nil
+	})
+	sort.Strings(found)
+	var out, skipped []string
+	for _, path := range found {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case fi.Size() > conf.MaxBytes:
+			skipped = append(skipped, fmt.Sprintf("`%s`: サイズ超過（%s > %s）", rel, formatBytes(fi.Size()), formatBytes(conf.MaxBytes)))
+		case len(out) >= conf.MaxFiles:
+			skipped = append(skipped, fmt.Sprintf("`%s`: 1ターン %d 件まで", rel, conf.MaxFiles))
+		default:
+			out = append(out, path)
+		}
+	}
+	if len(skipped) > 10 {
+		skipped = append(skipped[:10], fmt.Sprintf("…ほか %d 件", len(skipped)-10))
+	}
+	return out, skipped
+}
+
+// textFile wraps text as an upload, cut to max bytes on a line boundary.
+func textFile(name, text string, max int64) *discordgo.File {
+	if int64(len(text)) > max {
+		keep := max - 64
+		if keep < 0 {
+			keep = 0
+		}
+		cut := strings.LastIndexByte(text[:keep], '\n')
+		if cut < 0 {
+			cut = int(keep)
+		}
+		text = strings.ToValidUTF8(text[:cut], "") + "\n… (truncated)\n"
+	}
+	return &discordgo.File{Name: name, ContentType: "text/plain; charset=utf-8", Reader: strings.NewReader(text)}
+}
+
+// uploadReply posts the final reply as reply.txt when it took more than
+// reply_chunks messages, so it can be read in one piece.
+func (b *Bot) uploadReply(channelID, text string, parts int) {
+	conf := b.settings().artifacts
+	if conf.Disabled || parts <= conf.ReplyChunks {
+		return
+	}
+	_, err := b.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: fmt.Sprintf("📄 応答の全文（%d メッセージ分）", parts),
+		Files:   []*discordgo.File{textFile("reply.txt", text, conf.MaxBytes)},
+	})
+	if err != nil {
+		b.reportErrorf("artifacts", err)
+	}
+}
+
+// longOutputFile returns text as an attachment when it was clipped for display
+// (more than shown runes), or nil.
+func (b *Bot) longOutputFile(name, text string, shown int) []*discordgo.File {
+	conf := b.settings().artifacts
+	if conf.Disabled || len([]rune(text)) <= shown {
+		return nil
+	}
+	slog.Debug("artifacts: attaching", "name", name, "bytes", len(text))
+	return []*discordgo.File{textFile(name, text, conf.MaxBytes)}
+}
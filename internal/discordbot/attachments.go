@@ -0,0 +1,290 @@
+package discordbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	attachmentImage = "image"
+	attachmentText  = "text"
+)
+
+// savedAttachment is a Discord attachment written to the scratch directory.
+type savedAttachment struct {
+	kind        string
+	name        string
+	path        string
+	contentType string
+	size        int64
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+var attachmentClient = &http.Client{Timeout: 30 * time.Second}
+
+// attachmentTTL is how long a message's files are kept. Later turns of the
+// conversation may refer to them, so they are not removed when their turn
+// ends; a later save removes them once they are older than this.
+const attachmentTTL = 24 * time.Hour
+
+// WithAttachments sets the limits and types for attachments handed to Codex.
+func (b *Bot) WithAttachments(conf config.Attachments) *Bot {
+	b.update(func(s *settings) { s.attachments = conf.WithDefaults() })
+	return b
+}
+
+// saveAttachments downloads the message's attachments into the channel's
+// scratch directory. Images and text files within the limits are saved; the
+// rest are returned as human-readable skip reasons.
+func (b *Bot) saveAttachments(ctx context.Context, ch config.Channel, m *discordgo.Message) ([]savedAttachment, []string) {
+	conf := b.settings().attachments
+	if conf.Disabled || len(m.Attachments) == 0 {
+		return nil, nil
+	}
+	dir, err := scratchDir(conf, ch, m.ID)
+	if err != nil {
+		b.reportErrorf("attachments", err)
+		return nil, []string{"保存先を用意できなかった"}
+	}
+	var saved []savedAttachment
+	var skipped []string
+	used := map[string]bool{}
+	prepared := false
+	for i, a := range m.Attachments {
+		if i >= conf.MaxFiles {
+			skipped = append(skipped, fmt.Sprintf("`%s`: 1メッセージ %d 件まで", a.Filename, conf.MaxFiles))
+			continue
+		}
+		if int64(a.Size) > conf.MaxBytes {
+			skipped = append(skipped, fmt.Sprintf("`%s`: サイズ超過（%s > %s）", a.Filename, formatBytes(int64(a.Size)), formatBytes(conf.MaxBytes)))
+			continue
+		}
+		ctype := attachmentType(a)
+		kind := ""
+		switch {
+		case matchMIME(conf.ImageTypes, ctype):
+			kind = attachmentImage
+		case matchMIME(conf.TextTypes, ctype), ctype == "":
+			// unknown types are accepted as text if the content turns out to be text
+			kind = attachmentText
+		default:
+			skipped = append(skipped, fmt.Sprintf("`%s`: 未対応の形式（%s）", a.Filename, ctype))
+			continue
+		}
+		data, err := download(ctx, a.URL, conf.MaxBytes)
+		if err != nil {
+			skipped = append(skipped, fmt.Sprintf("`%s`: %v", a.Filename, err))
+			continue
+		}
+		if kind == attachmentText && !isText(data) {
+			skipped = append(skipped, fmt.Sprintf("`%s`: テキストではない", a.Filename))
+			continue
+		}
+		name := uniqueName(used, a.Filename)
+		path := filepath.Join(dir, name)
+		if !prepared {
+			if err := prepareScratch(dir); err != nil {
+				b.reportErrorf("attachments", err)
+				return saved, append(skipped, "保存先を用意できなかった")
+			}
+			prepared = true
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			b.reportErrorf("attachments", err)
+			skipped = append(skipped, fmt.Sprintf("`%s`: 保存に失敗した", a.Filename))
+			continue
+		}
+		if ctype == "" {
+			ctype = "text/plain"
+		}
+		saved = append(saved, savedAttachment{kind: kind, name: a.Filename, path: path, contentType: ctype, size: int64(len(data))})
+	}
+	return saved, skipped
+}
+
+// scratchDir is the directory for one message's files under scratchRoot.
+func scratchDir(conf config.Attachments, ch config.Channel, messageID string) (string, error) {
+	if messageID == "" || strings.ContainsAny(messageID, `/\.`) {
+		return "", fmt.Errorf("attachments: bad message id %q", messageID)
+	}
+	return filepath.Join(scratchRoot(conf, ch), messageID), nil
+}
+
+// scratchRoot is <workdir>/<scratch_dir>, or <scratch_dir> when absolute.
+// Channels without a workdir (unmapped ones) use the system temp directory
+// instead of the bot's own working directory.
+func scratchRoot(conf config.Attachments, ch config.Channel) string {
+	dir := conf.ScratchDir
+	switch {
+	case filepath.IsAbs(dir):
+		return dir
+	case ch.Workdir == "":
+		return filepath.Join(os.TempDir(), "discodex-attachments")
+	}
+	return filepath.Join(ch.Workdir, dir)
+}
+
+// scratchRel is scratchRoot relative to the workdir in slash form, as paths
+// appear in the turn diff; "" when it is outside the workdir.
+func scratchRel(conf config.Attachments, ch config.Channel) string {
+	if ch.Workdir == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(ch.Workdir, scratchRoot(conf, ch))
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// prepareScratch creates a message directory. The root gets a .gitignore so
+// the files stay out of `git status`, and directories older than
+// attachmentTTL are removed.
+func prepareScratch(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	root := filepath.Dir(dir)
+	ignore := filepath.Join(root, ".gitignore")
+	if _, err := os.Stat(ignore); errors.Is(err, os.ErrNotExist) {
+		_ = os.WriteFile(ignore, []byte("*\n"), 0o644)
+	}
+	entries, _ := os.ReadDir(root)
+	for _, e := range entries {
+		if !e.IsDir() || filepath.Join(root, e.Name()) == dir {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > attachmentTTL {
+			_ = os.RemoveAll(filepath.Join(root, e.Name()))
+		}
+	}
+	return nil
+}
+
+// attachmentPrompt appends references to the saved files to prompt. Images
+// also go to Codex as image inputs (see attachmentImages); the paths are kept
+// for backends that cannot take them.
+func attachmentPrompt(prompt string, saved []savedAttachment) string {
+	if len(saved) == 0 {
+		return prompt
+	}
+	var sb strings.Builder
+	if strings.TrimSpace(prompt) == "" {
+		prompt = "添付ファイルを確認して"
+	}
+	sb.WriteString(prompt)
+	sb.WriteString("\n\n添付ファイル（Discordから保存）:\n")
+	for _, a := range saved {
+		switch a.kind {
+		case attachmentImage:
+			fmt.Fprintf(&sb, "- 画像 `%s`（%s, %s）: 画像入力として添付\n", a.path, a.contentType, formatBytes(a.size))
+		default:
+			fmt.Fprintf(&sb, "- テキスト `%s`（%s, %s）\n", a.path, a.contentType, formatBytes(a.size))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// attachmentImages lists the saved images' paths for codex.WithImages.
+func attachmentImages(saved []savedAttachment) []string {
+	var paths []string
+	for _, a := range saved {
+		if a.kind == attachmentImage {
+			paths = append(paths, a.path)
+		}
+	}
+	return paths
+}
+
+// attachmentType is the attachment's MIME type without parameters, guessed
+// from the extension when Discord did not report one.
+func attachmentType(a *discordgo.MessageAttachment) string {
+	ctype := a.ContentType
+	if ctype == "" {
+		ctype = mime.TypeByExtension(strings.ToLower(filepath.Ext(a.Filename)))
+	}
+	if mt, _, err := mime.ParseMediaType(ctype); err == nil {
+		return mt
+	}
+	return ""
+}
+
+// matchMIME reports whether ctype matches one of patterns ("text/*" style
+// wildcards allowed).
+func matchMIME(patterns []string, ctype string) bool {
+	if ctype == "" {
+		return false
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == ctype || (strings.HasSuffix(p, "/*") && strings.HasPrefix(ctype, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := attachmentClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ダウンロードに失敗した")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ダウンロードに失敗した（HTTP %d）", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("ダウンロードに失敗した")
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("サイズ超過（> %s）", formatBytes(limit))
+	}
+	return data, nil
+}
+
+func isText(data []byte) bool {
+	return utf8.Valid(data) && !strings.ContainsRune(string(data), 0)
+}
+
+// uniqueName sanitizes a file name and makes it unique within one message.
+func uniqueName(used map[string]bool, name string) string {
+	name = unsafeFileChars.ReplaceAllString(filepath.Base(name), "_")
+	if name == "" || name == "." || name == ".." || strings.Trim(name, "_") == "" {
+		name = "attachment"
+	}
+	base, ext := strings.TrimSuffix(name, filepath.Ext(name)), filepath.Ext(name)
+	for n := 2; used[name]; n++ {
+		name = fmt.Sprintf("%s-%d%s", base, n, ext)
+	}
+	used[name] = true
+	return name
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
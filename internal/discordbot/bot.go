@@ -2,14 +2,19 @@ package discordbot
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aoisensi/discodex/internal/codex"
 	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/aoisensi/discodex/internal/metrics"
+	"github.com/aoisensi/discodex/internal/store"
 	"github.com/bwmarrin/discordgo"
 )
 
@@ -20,26 +25,52 @@ type Bot struct {
 	appID   string
 	guildID string
 
-	channelMap map[string]config.Channel
-	stopCh     chan struct{}
+	// reloadable settings (channel map, log channel, ACL, ...); see reload.go
+	conf   atomic.Pointer[settings]
+	stopCh chan struct{}
 
-	onChat  func(ctx context.Context, ch config.Channel, prompt string) ([]string, error)
-	onReset func(ctx context.Context, ch config.Channel) error
+	onChat   func(ctx context.Context, ch config.Channel, prompt string) ([]string, error)
+	onReset  func(ctx context.Context, ch config.Channel) error
+	onStatus func(ch config.Channel) codex.Status
+	onCancel func(ch config.Channel) bool
+	onUsage  func(ch config.Channel, userID string) codex.UsageReport
 
 	// streaming state
-	streams map[string]*streamState
-
-	// detailed error log destination channel
-	logChannelID string
-
-	// typing indicator controllers per channel
-	typing map[string]context.CancelFunc
+	streamMu sync.Mutex
+	streams  map[string]*streamState
+
+	// tool event embeds updated in place (exec/patch/mcp by call id, plan, diff)
+	eventMu   sync.Mutex
+	eventMsgs map[string]*eventMsg
+
+	// persistence of in-flight stream messages (nil: disabled)
+	store store.Store
+
+	// typing indicator controllers per channel; startTyping and stopTyping
+	// are called with and without streamMu, so the map has its own lock
+	typingMu sync.Mutex
+	typing   map[string]context.CancelFunc
+
+	// guards state touched from interaction handlers
+	mu sync.Mutex
+	// approval token -> waiting RequestApproval
+	approvals map[string]chan codex.ApprovalDecision
+	// channelID -> settings changed via /codex model, /codex cwd
+	overrides map[string]channelOverride
+	// prompt messageID -> prompt while its turn is queued or running (❌ to cancel)
+	prompts map[string]*pendingPrompt
+	// channelID -> artifacts of the running turn (guarded by eventMu)
+	artifacts map[string]*turnArtifacts
+	// channelID -> context of the running turn, for log lines about its stream
+	turns map[string]context.Context
 }
 
 type streamState struct {
-	messageID string
-	content   string
-	lastEdit  time.Time
+	// messageIDs are the stream's messages in order; sent is what each shows
+	messageIDs []string
+	sent       []string
+	content    string
+	lastEdit   time.Time
 }
 
 func New(token string, guildID string) (*Bot, error) {
@@ -54,10 +85,23 @@ func New(token string, guildID string) (*Bot, error) {
 		stopCh:  make(chan struct{}),
 		streams: map[string]*streamState{},
 		typing:  map[string]context.CancelFunc{},
+
+		eventMsgs: map[string]*eventMsg{},
+
+		approvals: map[string]chan codex.ApprovalDecision{},
+		overrides: map[string]channelOverride{},
+		prompts:   map[string]*pendingPrompt{},
+
+		artifacts: map[string]*turnArtifacts{},
+		turns:     map[string]context.Context{},
 	}
-	b.session.Identify.Intents = discordgo.IntentGuilds | discordgo.IntentGuildMessages | discordgo.IntentMessageContent
+	b.session.Identify.Intents = discordgo.IntentGuilds | discordgo.IntentGuildMessages | discordgo.IntentGuildMessageReactions | discordgo.IntentMessageContent
 	b.session.AddHandler(b.onReady)
 	b.session.AddHandler(b.onMessageCreate)
+	b.session.AddHandler(b.onInteractionCreate)
+	b.session.AddHandler(b.onReactionAdd)
+	b.session.AddHandler(b.onThreadUpdate)
+	b.session.AddHandler(b.onThreadDelete)
 	return b, nil
 }
 
@@ -71,13 +115,45 @@ func (b *Bot) WithResetHandler(reset func(ctx context.Context, ch config.Channel
 	return b
 }
 
+// WithStatusHandler registers the source of /codex status information.
+func (b *Bot) WithStatusHandler(status func(ch config.Channel) codex.Status) *Bot {
+	b.onStatus = status
+	return b
+}
+
+// WithUsageHandler registers the source of /codex usage information.
+func (b *Bot) WithUsageHandler(usage func(ch config.Channel, userID string) codex.UsageReport) *Bot {
+	b.onUsage = usage
+	return b
+}
+
+// WithCancelHandler registers the handler behind /codex cancel. It reports
+// whether anything was running.
+func (b *Bot) WithCancelHandler(cancel func(ch config.Channel) bool) *Bot {
+	b.onCancel = cancel
+	return b
+}
+
+// WithStore records in-flight stream messages so a restart can mark them as
+// interrupted instead of leaving them half-written.
+func (b *Bot) WithStore(s store.Store) *Bot {
+	b.store = s
+	return b
+}
+
 func (b *Bot) WithChannelMap(m map[string]config.Channel) *Bot {
-	b.channelMap = m
+	b.update(func(s *settings) { s.channelMap = m })
+	return b
+}
+
+// WithCodex sets the [codex] defaults that channel settings fall back to.
+func (b *Bot) WithCodex(conf config.Codex) *Bot {
+	b.update(func(s *settings) { s.codex = conf })
 	return b
 }
 
 func (b *Bot) WithLogChannel(id string) *Bot {
-	b.logChannelID = strings.TrimSpace(id)
+	b.update(func(s *settings) { s.logChannelID = strings.TrimSpace(id) })
 	return b
 }
 
@@ -90,6 +166,12 @@ func (b *Bot) Run() error {
 	if app, err := b.session.Application("@me"); err == nil {
 		b.appID = app.ID
 	}
+	if b.appID != "" {
+		if err := b.registerCommands(); err != nil {
+			b.reportErrorf("commands", err)
+		}
+	}
+	b.finalizeStaleStreams()
 
 	// Block until Stop is called
 	<-b.stopCh
@@ -98,7 +180,7 @@ func (b *Bot) Run() error {
 }
 
 func (b *Bot) onReady(s *discordgo.Session, r *discordgo.Ready) {
-	log.Printf("logged in as %s#%s", r.User.Username, r.User.Discriminator)
+	slog.Info("discord: logged in", "user", r.User.Username+"#"+r.User.Discriminator)
 }
 
 // Stop closes the Discord session and unblocks Run.
@@ -145,31 +227,74 @@ func (b *Bot) SetAway() {
 	_ = b.session.UpdateStatusComplex(discordgo.UpdateStatusData{Status: "idle", Activities: nil})
 }
 
-// ApplyStreamDelta appends delta for request and edits the message.
+// ApplyStreamDelta appends delta for request and edits the message(s). Text
+// past Discord's length limit rolls over into continuation messages.
 func (b *Bot) ApplyStreamDelta(channelID string, requestID int64, delta string) {
 	if b.session == nil {
 		return
 	}
+	b.streamMu.Lock()
+	defer b.streamMu.Unlock()
 	// ensure typing indicator is active during streaming
 	b.startTyping(channelID)
 	key := fmt.Sprintf("%s#%d", channelID, requestID)
 	st, ok := b.streams[key]
 	if !ok {
-		// create new message with initial delta
-		msg, err := b.session.ChannelMessageSend(channelID, delta)
-		if err != nil {
-			return
-		}
-		b.streams[key] = &streamState{messageID: msg.ID, content: delta, lastEdit: time.Now()}
-		return
+		st = &streamState{}
+		b.streams[key] = st
+		slog.DebugContext(b.turnContext(channelID), "stream: first delta", logging.KeyRPC, requestID)
 	}
 	st.content += delta
-	// simple throttle to avoid hitting rate limits
-	if time.Since(st.lastEdit) < 250*time.Millisecond {
+	// simple throttle to avoid hitting rate limits; a new message is always sent
+	parts := splitMarkdown(st.content, messageLimit)
+	if ok && len(parts) <= len(st.messageIDs) && time.Since(st.lastEdit) < 250*time.Millisecond {
 		return
 	}
 	st.lastEdit = time.Now()
-	_, _ = b.session.ChannelMessageEdit(channelID, st.messageID, st.content)
+	b.renderStream(channelID, st, parts, true)
+}
+
+// renderStream brings the stream's messages in line with parts: changed
+// messages are edited and missing ones sent. While live, only the last message
+// carries the Stop button.
+func (b *Bot) renderStream(channelID string, st *streamState, parts []string, live bool) {
+	for i, part := range parts {
+		last := i == len(parts)-1
+		if i < len(st.messageIDs) {
+			// the button moves to the newest message
+			dropButton := live && !last && i == len(st.messageIDs)-1
+			if part == st.sent[i] && !dropButton {
+				continue
+			}
+			edit := &discordgo.MessageEdit{ID: st.messageIDs[i], Channel: channelID, Content: &part}
+			if dropButton || !live {
+				empty := []discordgo.MessageComponent{}
+				edit.Components = &empty
+			}
+			if _, err := b.session.ChannelMessageEditComplex(edit); err != nil {
+				metrics.DiscordErrors.Inc("edit")
+			} else {
+				st.sent[i] = part
+			}
+			continue
+		}
+		send := &discordgo.MessageSend{Content: part}
+		if live && last {
+			send.Components = stopButton(channelID)
+		}
+		msg, err := b.session.ChannelMessageSendComplex(channelID, send)
+		if err != nil {
+			metrics.DiscordErrors.Inc("send")
+			return
+		}
+		st.messageIDs = append(st.messageIDs, msg.ID)
+		st.sent = append(st.sent, part)
+		if live && b.store != nil {
+			if err := b.store.PutStream(store.Stream{ChannelID: channelID, MessageID: msg.ID, StartedAt: time.Now()}); err != nil {
+				slog.Error("state: save stream", logging.KeyChannel, channelID, "error", err)
+			}
+		}
+	}
 }
 
 // EndStream finalizes the stream by setting final text and clearing state.
@@ -177,24 +302,118 @@ func (b *Bot) EndStream(channelID string, requestID int64, final string) {
 	if b.session == nil {
 		return
 	}
+	b.streamMu.Lock()
+	defer b.streamMu.Unlock()
 	key := fmt.Sprintf("%s#%d", channelID, requestID)
 	st, ok := b.streams[key]
 	if !ok {
 		if strings.TrimSpace(final) != "" {
 			// no prior delta; briefly show typing before sending final
 			_ = b.session.ChannelTyping(channelID)
-			_, _ = b.session.ChannelMessageSend(channelID, final)
+			parts := splitMarkdown(final, messageLimit)
+			b.renderStream(channelID, &streamState{}, parts, false)
+			b.uploadReply(channelID, final, len(parts))
 		}
 		return
 	}
 	if strings.TrimSpace(final) != "" {
 		st.content = final
 	}
-	_, _ = b.session.ChannelMessageEdit(channelID, st.messageID, st.content)
+	b.noteReplyPaths(channelID, st.content)
+	b.finishStream(channelID, st, st.content)
+	b.uploadReply(channelID, st.content, len(st.messageIDs))
+	slog.DebugContext(b.turnContext(channelID), "stream: final edit", logging.KeyRPC, requestID, "messages", len(st.messageIDs), "chars", len(st.content))
+	delete(b.streams, key)
+	b.stopTyping(channelID)
+}
+
+// CancelStream finalizes a partial stream with a cancelled marker.
+func (b *Bot) CancelStream(channelID string, requestID int64) {
+	if b.session == nil {
+		return
+	}
+	b.streamMu.Lock()
+	defer b.streamMu.Unlock()
+	key := fmt.Sprintf("%s#%d", channelID, requestID)
+	st, ok := b.streams[key]
+	// the aborted turn's turn_complete may never reach HandleEvent
+	b.forgetTurnEvents(channelID)
+	if !ok {
+		_, _ = b.session.ChannelMessageSend(channelID, "⏹️ キャンセルされた")
+		b.stopTyping(channelID)
+		return
+	}
+	b.finishStream(channelID, st, strings.TrimRight(st.content, "\n")+"\n\n⏹️ *キャンセルされた*")
 	delete(b.streams, key)
 	b.stopTyping(channelID)
 }
 
+// finishStream renders the final content with the same split as the live
+// stream, removes the Stop button and forgets the messages in the store.
+// Messages left over from a longer partial text are deleted.
+func (b *Bot) finishStream(channelID string, st *streamState, content string) {
+	parts := splitMarkdown(content, messageLimit)
+	for len(st.messageIDs) > len(parts) && len(st.messageIDs) > 1 {
+		n := len(st.messageIDs) - 1
+		_ = b.session.ChannelMessageDelete(channelID, st.messageIDs[n])
+		b.forgetStream(st.messageIDs[n])
+		st.messageIDs, st.sent = st.messageIDs[:n], st.sent[:n]
+	}
+	if len(parts) == 0 {
+		parts = []string{"（空の応答）"}
+	}
+	// force an edit of the last live message so its button goes away
+	if n := len(st.messageIDs); n > 0 {
+		st.sent[n-1] = ""
+	}
+	b.renderStream(channelID, st, parts, false)
+	for _, id := range st.messageIDs {
+		b.forgetStream(id)
+	}
+}
+
+// finishStreamMessage writes the final content and removes the Stop button.
+func (b *Bot) finishStreamMessage(channelID, messageID, content string) {
+	empty := []discordgo.MessageComponent{}
+	if _, err := b.session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         messageID,
+		Channel:    channelID,
+		Content:    &content,
+		Components: &empty,
+	}); err != nil {
+		metrics.DiscordErrors.Inc("edit")
+	}
+	b.forgetStream(messageID)
+}
+
+func (b *Bot) forgetStream(messageID string) {
+	if b.store != nil {
+		if err := b.store.DeleteStream(messageID); err != nil {
+			slog.Error("state: delete stream", "message", messageID, "error", err)
+		}
+	}
+}
+
+// finalizeStaleStreams marks messages that were still streaming when the bot
+// last stopped.
+func (b *Bot) finalizeStaleStreams() {
+	if b.store == nil {
+		return
+	}
+	streams, err := b.store.Streams()
+	if err != nil {
+		slog.Error("state: load streams", "error", err)
+		return
+	}
+	for _, st := range streams {
+		content := ""
+		if msg, err := b.session.ChannelMessage(st.ChannelID, st.MessageID); err == nil {
+			content = strings.TrimRight(clip(msg.Content, messageLimit-40), "\n") + "\n\n"
+		}
+		b.finishStreamMessage(st.ChannelID, st.MessageID, content+"⚠️ *再起動により中断された*")
+	}
+}
+
 // NotifyShutdown posts a shutdown notice to mapped channels and sets presence offline.
 func (b *Bot) NotifyShutdown(msg string) {
 	if b.session == nil {
@@ -203,8 +422,8 @@ func (b *Bot) NotifyShutdown(msg string) {
 	if strings.TrimSpace(msg) == "" {
 		msg = "discodex: 終了する"
 	}
-	for chID := range b.channelMap {
-		_, _ = b.session.ChannelMessageSend(chID, msg)
+	for chID := range b.settings().channelMap {
+		b.sendText(chID, msg)
 	}
 	_ = b.session.UpdateStatusComplex(discordgo.UpdateStatusData{Status: "invisible", Activities: nil})
 }
@@ -214,10 +433,9 @@ func (b *Bot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate)
 		return
 	}
 	botID := s.State.User.ID
-	ch, mapped := b.channelMap[m.ChannelID]
-	if debugEnabled() {
-		log.Printf("msg: ch=%s author=%s content.len=%d mentions=%d mapped=%v", m.ChannelID, m.Author.ID, len(m.Content), len(m.Mentions), mapped)
-	}
+	ch, mapped := b.channel(m.ChannelID)
+	lctx := logging.With(context.Background(), logging.KeyMessage, m.ID, logging.KeyChannel, m.ChannelID, logging.KeyUser, m.Author.ID)
+	slog.DebugContext(lctx, "msg: received", "content_len", len(m.Content), "mentions", len(m.Mentions), "mapped", mapped)
 	var prompt string
 	if mapped {
 		// 紐付け済みチャンネルはメンション不要で全メッセージを扱う
@@ -227,63 +445,256 @@ func (b *Bot) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate)
 			return
 		}
 		prompt = stripMention(m.Content, botID)
-		// 会話コンテキストをチャンネル単位で保持できるよう、未紐付けでも一時的にIDを設定
-		if ch.ChannelID == "" {
-			ch.ChannelID = m.ChannelID
-		}
 	}
 	prompt = strings.TrimSpace(prompt)
+	level, action := config.ACLChat, "chat"
+	if prompt == "/reset" {
+		level, action = config.ACLReset, "/reset"
+	}
+	if !b.permit(ch, level, messageActor(m.Message), action) {
+		_ = s.MessageReactionAdd(m.ChannelID, m.ID, deniedEmoji)
+		return
+	}
 	if prompt == "/reset" {
 		if b.onReset != nil {
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
-			if err := b.onReset(ctx, ch); err != nil {
-				b.reportErrorf("reset", err)
-				_, _ = s.ChannelMessageSend(m.ChannelID, "リセットに失敗した")
-			} else {
-				// clear local stream state too
-				b.ResetChannelStreams(m.ChannelID)
-				b.ClearStatus()
-				_, _ = s.ChannelMessageSend(m.ChannelID, "会話をリセットした")
-			}
+			_, _ = s.ChannelMessageSend(m.ChannelID, b.resetReply(b.resetChannel(ch)))
 		}
 		return
 	}
-	if strings.TrimSpace(prompt) == "" {
-		if debugEnabled() {
-			log.Printf("msg: empty content; Message Content Intent 未許可の可能性")
-		}
+	if strings.TrimSpace(prompt) == "" && len(m.Attachments) == 0 {
+		slog.DebugContext(lctx, "msg: empty content; Message Content Intent 未許可の可能性")
 		return
 	}
+	if mapped && ch.Threads {
+		if _, top := b.settings().channelMap[m.ChannelID]; top {
+			// トップレベルの投稿はスレッドを作り、そのスレッドを1つの会話にする
+			name := prompt
+			if name == "" && len(m.Attachments) > 0 {
+				name = m.Attachments[0].Filename
+			}
+			threadID, err := b.startThread(m, name)
+			if err != nil {
+				b.reportErrorf("thread", err)
+			} else {
+				ch.ChannelID = threadID
+				ch.ParentID = m.ChannelID
+			}
+		}
+	}
 	// タイピングはAIの出力が確定してから開始（delta受信時など）
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	// 承認待ちで長引くことがあるため、期限はブリッジ側の timeout_seconds に任せる
+	ctx, cancel := context.WithCancel(logging.With(lctx, logging.KeyChannel, ch.ChannelID))
 	defer cancel()
 	// attach user tag for Codex
 	tag := buildUserTag(m)
 	if tag != "" {
 		ctx = codex.WithUserTag(ctx, tag)
 	}
+	ctx = codex.WithUserID(ctx, m.Author.ID)
+	// 添付ファイルは scratch_dir に保存してプロンプトからパスで参照させ、画像は画像入力としても渡す。
+	// 後のターンからも参照できるよう、ファイルは attachmentTTL の間残す
+	saved, skipped := b.saveAttachments(ctx, ch, m.Message)
+	if len(skipped) > 0 {
+		b.sendText(ch.ChannelID, "⚠️ 添付ファイルをスキップした:\n- "+strings.Join(skipped, "\n- "))
+	}
+	prompt = attachmentPrompt(prompt, saved)
+	if imgs := attachmentImages(saved); len(imgs) > 0 {
+		ctx = codex.WithImages(ctx, imgs)
+	}
+	if strings.TrimSpace(prompt) == "" {
+		return
+	}
+	// 同じ会話のターンは順番待ちになる。待っている間は ⏳ と順番を表示
+	note := &queueNote{b: b, channelID: ch.ChannelID, msgChannelID: m.ChannelID, messageID: m.ID}
+	// the prompt can be cancelled with a ❌ reaction while it waits or runs
+	b.mu.Lock()
+	b.prompts[m.ID] = &pendingPrompt{channelID: ch.ChannelID, authorID: m.Author.ID, cancel: cancel, note: note}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.prompts, m.ID)
+		b.mu.Unlock()
+	}()
+	b.runChat(ctx, ch, prompt, note)
+}
+
+// channel returns the settings for a Discord channel with runtime overrides
+// (/codex model, /codex cwd) applied. Threads of a thread-mode channel inherit
+// the parent's settings. Unmapped channels get a zero config; ChannelID is
+// always the given id so conversation context is kept per channel/thread.
+func (b *Bot) channel(channelID string) (config.Channel, bool) {
+	ch, mapped := b.settings().channelMap[channelID]
+	ovKey := channelID
+	if !mapped {
+		// スレッドモードのチャンネル配下のスレッドは親の設定で独立した会話にする
+		if parent, ok := b.threadParent(channelID); ok {
+			ch, mapped = parent, true
+			ovKey = parent.ChannelID
+			ch.ParentID = parent.ChannelID
+		}
+	}
+	// 会話コンテキストをチャンネル単位で保持できるよう、未紐付けでも一時的にIDを設定
+	ch.ChannelID = channelID
+	b.mu.Lock()
+	ov, ok := b.overrides[ovKey]
+	b.mu.Unlock()
+	if ok {
+		if ov.model != "" {
+			ch.Model = ov.model
+		}
+		if ov.workdir != "" {
+			ch.Workdir = ov.workdir
+		}
+	}
+	return ch, mapped
+}
+
+// Channels lists the mapped channels and the channels with a /codex cwd or
+// model override, as turns see them (overrides applied).
+func (b *Bot) Channels() []config.Channel {
+	ids := map[string]bool{}
+	for id := range b.settings().channelMap {
+		ids[id] = true
+	}
+	b.mu.Lock()
+	for id := range b.overrides {
+		ids[id] = true
+	}
+	b.mu.Unlock()
+	chans := make([]config.Channel, 0, len(ids))
+	for id := range ids {
+		ch, _ := b.channel(id)
+		chans = append(chans, ch)
+	}
+	return chans
+}
+
+// resetChannel clears the Codex conversation and local stream state.
+func (b *Bot) resetChannel(ch config.Channel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := b.onReset(ctx, ch); err != nil {
+		return err
+	}
+	// clear local stream state too
+	b.ResetChannelStreams(ch.ChannelID)
+	b.ClearStatus()
+	return nil
+}
+
+// resetReply is the user-facing result of a reset; a failure other than a
+// busy conversation is also reported.
+func (b *Bot) resetReply(err error) string {
+	switch {
+	case err == nil:
+		return "会話をリセットした"
+	case errors.Is(err, codex.ErrBusy):
+		return resetBusyMessage
+	}
+	b.reportErrorf("reset", err)
+	return "リセットに失敗した"
+}
+
+// resetBusyMessage answers a reset refused because a turn is running or queued.
+const resetBusyMessage = "実行中または待機中のターンがあるのでリセットできない（終わってから、または /codex cancel の後でやり直して）"
+
+// runChat sends prompt to Codex and posts non-streamed replies to ch. note
+// shows the queue position while the conversation is busy (nil: a plain note).
+func (b *Bot) runChat(ctx context.Context, ch config.Channel, prompt string, note *queueNote) {
 	if b.onChat == nil {
-		_, _ = s.ChannelMessageSend(m.ChannelID, "ごめん、まだ会話は未実装だよ")
+		_, _ = b.session.ChannelMessageSend(ch.ChannelID, "ごめん、まだ会話は未実装だよ")
 		return
 	}
+	if note == nil {
+		note = &queueNote{b: b, channelID: ch.ChannelID}
+	}
+	defer note.done()
+	ctx = codex.WithQueueNotify(ctx, func(pos int) {
+		note.update(pos)
+		if pos == 0 {
+			// collect artifacts from when the turn actually starts
+			b.beginArtifacts(ch)
+			b.mu.Lock()
+			b.turns[ch.ChannelID] = ctx
+			b.mu.Unlock()
+		}
+	})
+	defer func() {
+		b.mu.Lock()
+		if b.turns[ch.ChannelID] == ctx {
+			delete(b.turns, ch.ChannelID)
+		}
+		b.mu.Unlock()
+	}()
+	slog.DebugContext(ctx, "chat: prompt", "prompt_len", len(prompt))
 	replies, err := b.onChat(ctx, ch, prompt)
 	if err != nil {
-		b.reportErrorf("chat", err)
-		replies = []string{"エラーが発生した"}
+		// a failed turn sends no turn_complete
+		b.forgetTurnEvents(ch.ChannelID)
+	}
+	if errors.Is(err, codex.ErrCancelled) {
+		// CancelStream already finalized the output
+		return
+	}
+	var qe *codex.QuotaError
+	if errors.As(err, &qe) {
+		b.stopTyping(ch.ChannelID)
+		_, _ = b.session.ChannelMessageSend(ch.ChannelID, quotaMessage(qe))
+		return
+	}
+	if msg := processErrorMessage(err); msg != "" {
+		// the exit itself was already reported through ReportExit / NotifyGaveUp
+		b.stopTyping(ch.ChannelID)
+		b.sendText(ch.ChannelID, msg)
+		return
+	}
+	if err != nil {
+		// the full error goes to the log channel, a short one to the chat
+		b.reportError(ctx, "chat", err)
+		replies = []string{chatErrorMessage(err)}
 	}
 	if len(replies) == 0 {
 		// streamingの場合はEndStreamで止める
 		return
 	}
 	// 非ストリーミング（即時応答）はここでtyping停止
-	b.stopTyping(m.ChannelID)
+	b.stopTyping(ch.ChannelID)
 	for _, msg := range replies {
-		msg = strings.TrimSpace(msg)
-		if msg == "" {
-			continue
+		b.sendText(ch.ChannelID, msg)
+	}
+}
+
+// chatErrorMessage is the reply for a failed turn.
+func chatErrorMessage(err error) string {
+	var re *codex.RPCError
+	if !errors.As(err, &re) {
+		return "エラーが発生した"
+	}
+	switch re.Kind() {
+	case codex.ErrorKindAuth:
+		return "⚠️ Codex の認証に失敗した。Bot を動かしているマシンで `codex login` の状態を確認してほしい"
+	case codex.ErrorKindRateLimit:
+		return "⚠️ OpenAI の利用上限（レート制限）に達した。しばらく待ってからもう一度送ってほしい"
+	case codex.ErrorKindContextWindow:
+		return "⚠️ 会話が長くなりすぎてモデルのコンテキストに収まらない。`/codex reset` で新しい会話を始めてほしい"
+	}
+	return fmt.Sprintf("エラーが発生した（%s）", clip(re.Message, 200))
+}
+
+func (b *Bot) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	switch i.Type {
+	case discordgo.InteractionApplicationCommand:
+		if i.ApplicationCommandData().Name == commandName {
+			b.handleCodexCommand(s, i)
+		}
+	case discordgo.InteractionMessageComponent:
+		id := i.MessageComponentData().CustomID
+		switch {
+		case strings.HasPrefix(id, approvalPrefix):
+			b.handleApprovalClick(s, i, id)
+		case strings.HasPrefix(id, cancelPrefix):
+			b.handleCancelClick(s, i, id)
 		}
-		_, _ = s.ChannelMessageSend(m.ChannelID, msg)
 	}
 }
 
@@ -312,6 +723,8 @@ func buildUserTag(m *discordgo.MessageCreate) string {
 
 // ResetChannelStreams clears any in-flight streaming state for a channel.
 func (b *Bot) ResetChannelStreams(channelID string) {
+	b.streamMu.Lock()
+	defer b.streamMu.Unlock()
 	if b.streams == nil {
 		return
 	}
@@ -328,6 +741,8 @@ func (b *Bot) startTyping(channelID string) {
 	if b.session == nil || channelID == "" {
 		return
 	}
+	b.typingMu.Lock()
+	defer b.typingMu.Unlock()
 	if b.typing == nil {
 		b.typing = map[string]context.CancelFunc{}
 	}
@@ -354,6 +769,8 @@ func (b *Bot) startTyping(channelID string) {
 
 // stopTyping cancels the typing ticker for a channel.
 func (b *Bot) stopTyping(channelID string) {
+	b.typingMu.Lock()
+	defer b.typingMu.Unlock()
 	if b.typing == nil {
 		return
 	}
@@ -382,42 +799,48 @@ func isMentionedByArray(mentions []*discordgo.User, botID string) bool {
 	return false
 }
 
-func debugEnabled() bool {
-	if v, ok := os.LookupEnv("DISCODEX_DEBUG"); ok {
-		v = strings.ToLower(strings.TrimSpace(v))
-		return v != "" && v != "0" && v != "false"
+// turnContext returns the context of the channel's running turn, for log
+// lines about its stream.
+func (b *Bot) turnContext(channelID string) context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ctx, ok := b.turns[channelID]; ok {
+		return ctx
 	}
-	return false
+	return logging.With(context.Background(), logging.KeyChannel, channelID)
 }
 
 // reportErrorf posts detailed error to log channel if configured.
 func (b *Bot) reportErrorf(tag string, err error) {
+	b.reportError(context.Background(), tag, err)
+}
+
+// reportError logs err with the attributes of ctx and posts it to the log
+// channel if configured.
+func (b *Bot) reportError(ctx context.Context, tag string, err error) {
 	if err == nil {
 		return
 	}
 	msg := fmt.Sprintf("[%s] %v", tag, err)
-	if b.logChannelID != "" && b.session != nil {
-		for _, part := range splitDiscordMessage(msg) {
-			_, _ = b.session.ChannelMessageSend(b.logChannelID, part)
-		}
-		return
+	attrs := []any{"tag", tag, "error", err}
+	var ee *codex.ExitError
+	if errors.As(err, &ee) {
+		msg += stderrBlock(ee.Stderr)
+		attrs = append(attrs, "stderr", strings.Join(ee.Stderr, "\n"))
+	}
+	slog.ErrorContext(ctx, "error reported", attrs...)
+	if logID := b.settings().logChannelID; logID != "" && b.session != nil {
+		b.sendText(logID, msg)
 	}
-	log.Printf("%s", msg)
 }
 
-// splitDiscordMessage chunks text within ~1900 chars to avoid 2000 limit.
-func splitDiscordMessage(s string) []string {
-	const lim = 1900
-	if len(s) <= lim {
-		return []string{s}
-	}
-	var out []string
-	for i := 0; i < len(s); i += lim {
-		j := i + lim
-		if j > len(s) {
-			j = len(s)
+// sendText posts text, split into as many messages as Discord's limit needs.
+func (b *Bot) sendText(channelID, text string) {
+	for _, part := range splitMarkdown(text, messageLimit) {
+		if _, err := b.session.ChannelMessageSend(channelID, part); err != nil {
+			metrics.DiscordErrors.Inc("send")
+			slog.Warn("discord: send failed", logging.KeyChannel, channelID, "error", err)
+			return
 		}
-		out = append(out, s[i:j])
 	}
-	return out
 }
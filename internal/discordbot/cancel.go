@@ -0,0 +1,94 @@
+package discordbot
+
+import (
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	cancelPrefix = "cancel:"
+	cancelEmoji  = "❌"
+)
+
+// stopButton is attached to streaming messages so the turn can be aborted.
+func stopButton(channelID string) []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{Label: "Stop", Style: discordgo.SecondaryButton, CustomID: cancelPrefix + channelID, Emoji: &discordgo.ComponentEmoji{Name: "⏹️"}},
+	}}}
+}
+
+// cancelChannel asks Codex to abort the channel's running turn.
+func (b *Bot) cancelChannel(channelID string) bool {
+	if b.onCancel == nil {
+		return false
+	}
+	ch, _ := b.channel(channelID)
+	return b.onCancel(ch)
+}
+
+// cancelLevel is the ACL level userID needs to cancel a prompt by authorID:
+// chat for their own prompt, reset for someone else's.
+func cancelLevel(authorID, userID string) string {
+	if authorID != "" && authorID == userID {
+		return config.ACLChat
+	}
+	return config.ACLReset
+}
+
+// turnUser is the Discord user whose turn is running in the channel, or "".
+func (b *Bot) turnUser(channelID string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ctx, ok := b.turns[channelID]; ok {
+		return codex.UserIDFrom(ctx)
+	}
+	return ""
+}
+
+func (b *Bot) handleCancelClick(s *discordgo.Session, i *discordgo.InteractionCreate, customID string) {
+	channelID := strings.TrimPrefix(customID, cancelPrefix)
+	ch, _ := b.channel(channelID)
+	if !b.permitInteraction(s, i, ch, cancelLevel(b.turnUser(channelID), interactionUserID(i)), "cancel (button)") {
+		return
+	}
+	if !b.cancelChannel(channelID) {
+		respondEphemeral(s, i, "実行中のターンはない")
+		return
+	}
+	// CancelStream edits the message itself; just acknowledge the click
+	_ = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{Type: discordgo.InteractionResponseDeferredMessageUpdate})
+}
+
+// onReactionAdd cancels the turn when ❌ is added to its prompt message, or
+// removes the prompt from the queue if it has not started yet.
+func (b *Bot) onReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.Emoji.Name != cancelEmoji {
+		return
+	}
+	if s.State != nil && s.State.User != nil && r.UserID == s.State.User.ID {
+		return
+	}
+	b.mu.Lock()
+	pp, ok := b.prompts[r.MessageID]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+	a := actor{userID: r.UserID, guildID: r.GuildID}
+	if r.Member != nil {
+		a.roles = r.Member.Roles
+	}
+	ch, _ := b.channel(pp.channelID)
+	if !b.permit(ch, cancelLevel(pp.authorID, r.UserID), a, "cancel (reaction)") {
+		return
+	}
+	if pp.note.isWaiting() {
+		// still queued: drop only this prompt
+		pp.cancel()
+		return
+	}
+	b.cancelChannel(pp.channelID)
+}
@@ -0,0 +1,358 @@
+package discordbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/logging"
+	"github.com/bwmarrin/discordgo"
+)
+
+const commandName = "codex"
+
+// channelOverride holds per-channel settings changed at runtime by slash commands.
+type channelOverride struct {
+	model   string
+	workdir string
+}
+
+var modelNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]{0,63}$`)
+
+func applicationCommands() []*discordgo.ApplicationCommand {
+	noDM := false
+	minOne := 1
+	return []*discordgo.ApplicationCommand{{
+		Name:         commandName,
+		Description:  "Codex を操作する",
+		DMPermission: &noDM,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "ask",
+				Description: "Codex に質問する",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "prompt",
+					Description: "送る内容",
+					Required:    true,
+					MinLength:   &minOne,
+					MaxLength:   4000,
+				}},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "reset",
+				Description: "このチャンネルの会話をリセットする",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "status",
+				Description: "会話とプロセスの状態を表示する",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "stderr",
+					Description: "Codex プロセスの標準エラー出力（末尾）も表示する（admin のみ）",
+				}},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "cancel",
+				Description: "実行中のターンを中断する",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "usage",
+				Description: "トークン使用量と上限を表示する",
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "model",
+				Description: "このチャンネルで使うモデルを変更する（会話はリセットされる）",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "name",
+					Description: "モデル名。default で設定ファイルの値に戻す",
+					Required:    true,
+					MinLength:   &minOne,
+					MaxLength:   64,
+				}},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionSubCommand,
+				Name:        "cwd",
+				Description: "このチャンネルの作業ディレクトリを変更する（会話はリセットされる）",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "path",
+					Description: "絶対パス。default で設定ファイルの値に戻す",
+					Required:    true,
+					MinLength:   &minOne,
+					MaxLength:   1024,
+				}},
+			},
+		},
+	}}
+}
+
+// registerCommands installs the slash commands, guild-scoped when guild_id is
+// set and global otherwise. Bulk overwrite removes stale commands in that
+// scope; leftovers from a previous global registration are removed too.
+func (b *Bot) registerCommands() error {
+	cmds := applicationCommands()
+	if _, err := b.session.ApplicationCommandBulkOverwrite(b.appID, b.guildID, cmds); err != nil {
+		return fmt.Errorf("register commands (guild=%q): %w", b.guildID, err)
+	}
+	if b.guildID != "" {
+		global, err := b.session.ApplicationCommands(b.appID, "")
+		if err != nil {
+			return fmt.Errorf("list global commands: %w", err)
+		}
+		for _, c := range global {
+			if c.Name != commandName {
+				continue
+			}
+			if err := b.session.ApplicationCommandDelete(b.appID, "", c.ID); err != nil {
+				return fmt.Errorf("delete stale global command %s: %w", c.ID, err)
+			}
+		}
+	}
+	slog.Debug("commands: registered", "count", len(cmds), "guild", b.guildID)
+	return nil
+}
+
+func (b *Bot) handleCodexCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	data := i.ApplicationCommandData()
+	if len(data.Options) == 0 {
+		return
+	}
+	sub := data.Options[0]
+	opts := map[string]string{}
+	for _, o := range sub.Options {
+		switch o.Type {
+		case discordgo.ApplicationCommandOptionString:
+			opts[o.Name] = strings.TrimSpace(o.StringValue())
+		case discordgo.ApplicationCommandOptionBoolean:
+			opts[o.Name] = fmt.Sprint(o.BoolValue())
+		}
+	}
+	ch, _ := b.channel(i.ChannelID)
+	level := commandLevel(sub.Name)
+	if sub.Name == "cancel" {
+		level = cancelLevel(b.turnUser(ch.ChannelID), interactionUserID(i))
+	}
+	if !b.permitInteraction(s, i, ch, level, "/"+commandName+" "+sub.Name) {
+		return
+	}
+	switch sub.Name {
+	case "ask":
+		prompt := opts["prompt"]
+		if prompt == "" {
+			respondEphemeral(s, i, "prompt が空")
+			return
+		}
+		respondEphemeral(s, i, "送信した: "+clip(prompt, 200))
+		ctx := logging.With(context.Background(), logging.KeyInteraction, i.ID, logging.KeyChannel, ch.ChannelID, logging.KeyUser, interactionUserID(i))
+		if tag := interactionUserName(i); tag != "?" {
+			ctx = codex.WithUserTag(ctx, tag)
+		}
+		ctx = codex.WithUserID(ctx, interactionUserID(i))
+		go b.runChat(ctx, ch, prompt, nil)
+	case "reset":
+		if b.onReset == nil {
+			respondEphemeral(s, i, "リセットは未対応")
+			return
+		}
+		respondEphemeral(s, i, b.resetReply(b.resetChannel(ch)))
+	case "status":
+		stderr := opts["stderr"] == "true"
+		// stderr can carry paths, prompts and tokens from the Codex process
+		if stderr && !b.permitInteraction(s, i, ch, config.ACLAdmin, "/"+commandName+" status stderr") {
+			return
+		}
+		content, files := b.renderStatus(ch, stderr)
+		respondEphemeralFiles(s, i, content, files)
+	case "usage":
+		if b.onUsage == nil {
+			respondEphemeral(s, i, "使用量の集計は未対応")
+			return
+		}
+		respondEphemeral(s, i, renderUsage(ch, b.onUsage(ch, interactionUserID(i))))
+	case "cancel":
+		if b.onCancel == nil {
+			respondEphemeral(s, i, "キャンセルは未対応")
+			return
+		}
+		if !b.cancelChannel(ch.ChannelID) {
+			respondEphemeral(s, i, "実行中のターンはない")
+			return
+		}
+		respondEphemeral(s, i, "キャンセルした")
+	case "model":
+		name := opts["name"]
+		if name != "default" && !modelNamePattern.MatchString(name) {
+			respondEphemeral(s, i, "モデル名が不正: "+clip(name, 64))
+			return
+		}
+		if !b.resetForOverride(s, i, ch) {
+			return
+		}
+		b.setOverride(ch.ChannelID, func(ov *channelOverride) {
+			ov.model = name
+			if name == "default" {
+				ov.model = ""
+			}
+		})
+		ch, _ = b.channel(i.ChannelID)
+		respondEphemeral(s, i, fmt.Sprintf("モデルを `%s` にした（会話はリセット）", orDefault(ch.Model)))
+	case "cwd":
+		path := opts["path"]
+		if path != "default" {
+			if !filepath.IsAbs(path) {
+				respondEphemeral(s, i, "絶対パスで指定して")
+				return
+			}
+			path = filepath.Clean(path)
+			if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+				respondEphemeral(s, i, "ディレクトリが見つからない: "+clip(path, 200))
+				return
+			}
+		}
+		if !b.resetForOverride(s, i, ch) {
+			return
+		}
+		b.setOverride(ch.ChannelID, func(ov *channelOverride) {
+			ov.workdir = path
+			if path == "default" {
+				ov.workdir = ""
+			}
+		})
+		ch, _ = b.channel(i.ChannelID)
+		respondEphemeral(s, i, fmt.Sprintf("作業ディレクトリを `%s` にした（会話はリセット）", orDefault(ch.Workdir)))
+	}
+}
+
+// commandLevel is the ACL level a /codex subcommand needs. cancel needs reset
+// unless the turn is the caller's own (see cancelLevel).
+func commandLevel(sub string) string {
+	switch sub {
+	case "reset", "cancel":
+		return config.ACLReset
+	case "model", "cwd":
+		return config.ACLAdmin
+	}
+	return config.ACLChat
+}
+
+func (b *Bot) setOverride(channelID string, fn func(ov *channelOverride)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ov := b.overrides[channelID]
+	fn(&ov)
+	if ov == (channelOverride{}) {
+		delete(b.overrides, channelID)
+		return
+	}
+	b.overrides[channelID] = ov
+}
+
+// resetForOverride drops the conversation so a new model/cwd takes effect
+// (they are only sent when a conversation starts). It is done before the
+// override is stored: while a turn is running or queued the reset is refused,
+// and the override is then left unchanged too.
+func (b *Bot) resetForOverride(s *discordgo.Session, i *discordgo.InteractionCreate, ch config.Channel) bool {
+	if b.onReset == nil {
+		return true
+	}
+	err := b.resetChannel(ch)
+	if errors.Is(err, codex.ErrBusy) {
+		respondEphemeral(s, i, resetBusyMessage)
+		return false
+	}
+	if err != nil {
+		b.reportErrorf("reset", err)
+	}
+	return true
+}
+
+// renderStatus formats /codex status. With stderr, the process's stderr tail
+// is appended within the message limit; when it had to be clipped, the whole
+// tail is also returned as stderr.txt.
+func (b *Bot) renderStatus(ch config.Channel, stderr bool) (string, []*discordgo.File) {
+	var sb strings.Builder
+	_, mapped := b.settings().channelMap[ch.ChannelID]
+	fmt.Fprintf(&sb, "**discodex status** <#%s>\n", ch.ChannelID)
+	fmt.Fprintf(&sb, "- 紐付け: %v\n", mapped)
+	// the values a new conversation starts with, [codex] defaults applied
+	r := b.settings().codex.Resolve(ch)
+	fmt.Fprintf(&sb, "- モデル: `%s`\n", orDefault(r.Model))
+	fmt.Fprintf(&sb, "- サンドボックス: `%s` / 承認: `%s`\n", r.Sandbox, r.ApprovalPolicy)
+	if r.Profile != "" {
+		fmt.Fprintf(&sb, "- プロファイル: `%s`\n", r.Profile)
+	}
+	fmt.Fprintf(&sb, "- 作業ディレクトリ: `%s`\n", orDefault(ch.Workdir))
+	if b.onStatus == nil {
+		return sb.String(), nil
+	}
+	st := b.onStatus(ch)
+	if st.ConversationID != "" {
+		fmt.Fprintf(&sb, "- 会話ID: `%s`\n", st.ConversationID)
+	} else {
+		sb.WriteString("- 会話ID: (なし)\n")
+	}
+	state := "停止中"
+	if st.ProcessRunning {
+		state = "起動中"
+	}
+	if st.Backend != "" {
+		fmt.Fprintf(&sb, "- バックエンド: `%s`\n", st.Backend)
+	}
+	if st.Backend == config.BackendMCP || st.Backend == "" {
+		fmt.Fprintf(&sb, "- MCPプロセス: %s（処理中 %d 件）\n", state, st.Pending)
+		if st.Server != "" {
+			fmt.Fprintf(&sb, "- MCPサーバー: `%s`\n", st.Server)
+		}
+		if st.Restarts > 0 {
+			fmt.Fprintf(&sb, "- 自動再起動: %d 回\n", st.Restarts)
+		}
+		if !st.RetryAt.IsZero() {
+			fmt.Fprintf(&sb, "- 異常終了が続いたため停止中（%s 以降に再試行）\n", st.RetryAt.Format("15:04:05"))
+		}
+	} else {
+		fmt.Fprintf(&sb, "- Codexプロセス: %s\n", state)
+	}
+	if st.Queued > 0 {
+		fmt.Fprintf(&sb, "- 順番待ち: %d 件\n", st.Queued)
+	}
+	if !stderr {
+		return sb.String(), nil
+	}
+	if len(st.Stderr) == 0 {
+		sb.WriteString("- stderr: (なし)\n")
+		return sb.String(), nil
+	}
+	body := strings.ReplaceAll(strings.Join(st.Stderr, "\n"), "```", "'''")
+	const head, tail = "stderr（末尾）:\n```\n", "\n```"
+	budget := messageLimit - len([]rune(sb.String())) - len([]rune(head+tail))
+	var files []*discordgo.File
+	if len([]rune(body)) > budget {
+		files = []*discordgo.File{textFile("stderr.txt", strings.Join(st.Stderr, "\n"), b.settings().artifacts.MaxBytes)}
+		body = clipTail(body, max(budget, 1))
+	}
+	sb.WriteString(head + body + tail)
+	return sb.String(), files
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "(既定)"
+	}
+	return s
+}
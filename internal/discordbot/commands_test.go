@@ -0,0 +1,85 @@
+package discordbot
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+func TestRenderStatusEffective(t *testing.T) {
+	b := &Bot{}
+	b.WithCodex(config.Codex{Sandbox: "read-only", ApprovalPolicy: "on-request", Model: "o3"})
+	tests := []struct {
+		name string
+		ch   config.Channel
+		want []string
+	}{
+		{"defaults", config.Channel{ChannelID: "1"}, []string{"モデル: `o3`", "サンドボックス: `read-only` / 承認: `on-request`"}},
+		{"channel wins", config.Channel{ChannelID: "1", Sandbox: "danger-full-access", Model: "gpt-5"}, []string{"モデル: `gpt-5`", "サンドボックス: `danger-full-access` / 承認: `on-request`"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, _ := b.renderStatus(tt.ch, false)
+			for _, w := range tt.want {
+				if !strings.Contains(content, w) {
+					t.Errorf("status lacks %q:\n%s", w, content)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderStatusStderr(t *testing.T) {
+	ch := config.Channel{ChannelID: "1"}
+	tests := []struct {
+		name   string
+		stderr []string
+		file   bool
+	}{
+		{"none", nil, false},
+		{"short", []string{"warn: a", "warn: b"}, false},
+		{"long", []string{strings.Repeat("x", 1200), strings.Repeat("y", 1200)}, true},
+		{"many lines", strings.Split(strings.Repeat("line\n", 800), "\n"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bot{onStatus: func(config.Channel) codex.Status {
+				return codex.Status{Backend: config.BackendMCP, Stderr: tt.stderr}
+			}}
+			content, files := b.renderStatus(ch, true)
+			if n := len([]rune(content)); n > messageLimit {
+				t.Errorf("content is %d runes, over %d", n, messageLimit)
+			}
+			if got := len(files) > 0; got != tt.file {
+				t.Fatalf("attached stderr.txt = %v, want %v", got, tt.file)
+			}
+			if !tt.file {
+				return
+			}
+			data, _ := io.ReadAll(files[0].Reader)
+			if string(data) != strings.Join(tt.stderr, "\n") {
+				t.Errorf("stderr.txt does not hold the whole tail")
+			}
+		})
+	}
+}
+
+func TestCancelLevel(t *testing.T) {
+	tests := []struct {
+		name, author, user, want string
+	}{
+		{"own prompt", "1", "1", config.ACLChat},
+		{"someone else's", "1", "2", config.ACLReset},
+		{"no running turn", "", "2", config.ACLReset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cancelLevel(tt.author, tt.user); got != tt.want {
+				t.Errorf("cancelLevel(%q, %q) = %q, want %q", tt.author, tt.user, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package discordbot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	colorRunning = 0x95a5a6
+	colorOK      = 0x2ecc71
+	colorFail    = 0xe74c3c
+	colorInfo    = 0x3498db
+)
+
+// eventMsg is a posted embed that later events update in place.
+type eventMsg struct {
+	// set before sent is closed; empty when the send failed
+	messageID string
+	// detail kept from the begin event (e.g. the command line)
+	detail string
+	// closed once the embed has been sent
+	sent chan struct{}
+}
+
+// HandleEvent renders a typed Codex event as a compact embed, honoring the
+// channel's [channels.events] toggles. eventMu only guards the bookkeeping;
+// Discord calls are made without it so a slow channel does not hold up the
+// others.
+func (b *Bot) HandleEvent(channelID string, requestID int64, ev codex.Event) {
+	if b.session == nil {
+		return
+	}
+	ch, _ := b.channel(channelID)
+	if d, ok := ev.(codex.TurnDiff); ok {
+		// saved Discord attachments are not part of the work
+		ev = codex.TurnDiff{Diff: dropDiffFiles(d.Diff, scratchRel(b.settings().attachments, ch))}
+	}
+	b.eventMu.Lock()
+	// artifacts are collected even when the embeds are turned off
+	b.noteArtifacts(channelID, ev)
+	b.eventMu.Unlock()
+	if ev.Category() != codex.CategoryTurn && !ch.EventEnabled(ev.Category()) {
+		return
+	}
+	base := fmt.Sprintf("%s#%d#", channelID, requestID)
+	switch e := ev.(type) {
+	case codex.ExecBegin:
+		b.postEvent(channelID, base+e.CallID, e.Command, &discordgo.MessageEmbed{
+			Title:       "▶️ 実行中",
+			Description: codeBlock("sh", clip(e.Command, 500)),
+			Color:       colorRunning,
+		})
+	case codex.ExecEnd:
+		prev := b.takeEvent(base + e.CallID)
+		title, color := fmt.Sprintf("✅ exit %d", e.ExitCode), colorOK
+		if e.ExitCode != 0 {
+			title, color = fmt.Sprintf("❌ exit %d", e.ExitCode), colorFail
+		}
+		if e.Duration > 0 {
+			title += fmt.Sprintf(" (%s)", e.Duration.Round(100*time.Millisecond))
+		}
+		desc := codeBlock("sh", clip(prev.detailOf(), 300))
+		out := strings.TrimSpace(e.Output)
+		if out != "" {
+			desc += "\n" + codeBlock("", clipTail(out, 800))
+		}
+		// the full output goes up as a file when the embed only shows its tail
+		b.finishEvent(channelID, prev, &discordgo.MessageEmbed{Title: title, Description: desc, Color: color}, b.longOutputFile("output.txt", out, 800)...)
+	case codex.PatchBegin:
+		files := renderFileChanges(e.Files)
+		b.postEvent(channelID, base+e.CallID, files, &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("📝 パッチ適用中（%d ファイル）", len(e.Files)),
+			Description: files,
+			Color:       colorRunning,
+		})
+	case codex.PatchEnd:
+		prev := b.takeEvent(base + e.CallID)
+		title, color := "📝 パッチ適用", colorOK
+		// keep the file list from the begin event
+		desc := prev.detailOf()
+		var files []*discordgo.File
+		if !e.Success {
+			title, color = "📝 パッチ適用失敗", colorFail
+			if e.Output != "" {
+				desc += "\n" + codeBlock("", clipTail(e.Output, 600))
+				files = b.longOutputFile("patch-output.txt", e.Output, 600)
+			}
+		}
+		b.finishEvent(channelID, prev, &discordgo.MessageEmbed{Title: title, Description: desc, Color: color}, files...)
+	case codex.MCPToolBegin:
+		desc := ""
+		if e.Arguments != "" {
+			desc = codeBlock("json", clip(e.Arguments, 400))
+		}
+		b.postEvent(channelID, base+e.CallID, desc, &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("🔧 %s.%s", e.Server, e.Tool),
+			Description: desc,
+			Color:       colorRunning,
+		})
+	case codex.MCPToolEnd:
+		prev := b.takeEvent(base + e.CallID)
+		desc := prev.detailOf()
+		title, color := fmt.Sprintf("🔧 %s.%s", e.Server, e.Tool), colorOK
+		if e.Duration > 0 {
+			title += fmt.Sprintf(" (%s)", e.Duration.Round(100*time.Millisecond))
+		}
+		if e.Error != "" {
+			color = colorFail
+			desc += "\n" + codeBlock("", clip(e.Error, 400))
+		}
+		b.finishEvent(channelID, prev, &discordgo.MessageEmbed{Title: title, Description: desc, Color: color})
+	case codex.WebSearch:
+		_, _ = b.session.ChannelMessageSendEmbed(channelID, &discordgo.MessageEmbed{
+			Title:       "🔎 Web検索",
+			Description: clip(e.Query, 500),
+			Color:       colorInfo,
+		})
+	case codex.TurnDiff:
+		files := summarizeDiff(e.Diff)
+		if len(files) == 0 {
+			return
+		}
+		b.upsertEvent(channelID, base+"diff", &discordgo.MessageEmbed{
+			Title:       fmt.Sprintf("📄 このターンの変更（%d ファイル）", len(files)),
+			Description: renderFileChanges(files),
+			Color:       colorInfo,
+		})
+	case codex.PlanUpdate:
+		b.upsertEvent(channelID, base+"plan", &discordgo.MessageEmbed{
+			Title:       "🗒️ プラン",
+			Description: renderPlan(e),
+			Color:       colorInfo,
+		})
+	case codex.TurnComplete:
+		b.eventMu.Lock()
+		for k := range b.eventMsgs {
+			if strings.HasPrefix(k, base) {
+				delete(b.eventMsgs, k)
+			}
+		}
+		ta := b.takeArtifacts(channelID)
+		b.eventMu.Unlock()
+		if ta != nil && !e.Aborted {
+			go b.uploadArtifacts(channelID, ta)
+		}
+	}
+}
+
+// forgetTurnEvents drops the embeds and artifacts of the channel's turn when
+// it ended without a turn_complete (cancelled, failed, process gone).
+func (b *Bot) forgetTurnEvents(channelID string) {
+	prefix := channelID + "#"
+	b.eventMu.Lock()
+	defer b.eventMu.Unlock()
+	for k := range b.eventMsgs {
+		if strings.HasPrefix(k, prefix) {
+			delete(b.eventMsgs, k)
+		}
+	}
+	b.takeArtifacts(channelID)
+}
+
+// postEvent sends a new embed and remembers it under key. The entry is
+// registered before the send, so an end event arriving meanwhile waits for
+// the message instead of posting a second one.
+func (b *Bot) postEvent(channelID, key, detail string, em *discordgo.MessageEmbed) {
+	m := &eventMsg{detail: detail, sent: make(chan struct{})}
+	b.eventMu.Lock()
+	b.eventMsgs[key] = m
+	b.eventMu.Unlock()
+	b.sendEvent(channelID, m, em)
+}
+
+func (b *Bot) sendEvent(channelID string, m *eventMsg, em *discordgo.MessageEmbed) {
+	defer close(m.sent)
+	if msg, err := b.session.ChannelMessageSendEmbed(channelID, em); err == nil {
+		m.messageID = msg.ID
+	}
+}
+
+// takeEvent removes and returns the embed posted for key, or nil.
+func (b *Bot) takeEvent(key string) *eventMsg {
+	b.eventMu.Lock()
+	defer b.eventMu.Unlock()
+	m := b.eventMsgs[key]
+	delete(b.eventMsgs, key)
+	return m
+}
+
+func (m *eventMsg) detailOf() string {
+	if m == nil {
+		return ""
+	}
+	return m.detail
+}
+
+// finishEvent replaces the embed prev (from takeEvent) or, without one, posts
+// a new message. files (e.g. a full command output) are attached to it.
+func (b *Bot) finishEvent(channelID string, prev *eventMsg, em *discordgo.MessageEmbed, files ...*discordgo.File) {
+	if prev != nil {
+		<-prev.sent
+	}
+	if prev != nil && prev.messageID != "" {
+		embeds := []*discordgo.MessageEmbed{em}
+		_, _ = b.session.ChannelMessageEditComplex(&discordgo.MessageEdit{ID: prev.messageID, Channel: channelID, Embeds: &embeds, Files: files})
+		return
+	}
+	_, _ = b.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{em}, Files: files})
+}
+
+// upsertEvent keeps one live-updated embed per key (plan, turn diff).
+func (b *Bot) upsertEvent(channelID, key string, em *discordgo.MessageEmbed) {
+	b.eventMu.Lock()
+	prev, ok := b.eventMsgs[key]
+	if !ok {
+		prev = &eventMsg{sent: make(chan struct{})}
+		b.eventMsgs[key] = prev
+	}
+	b.eventMu.Unlock()
+	if !ok {
+		b.sendEvent(channelID, prev, em)
+		return
+	}
+	<-prev.sent
+	if prev.messageID != "" {
+		_, _ = b.session.ChannelMessageEditEmbed(channelID, prev.messageID, em)
+	}
+}
+
+func renderPlan(e codex.PlanUpdate) string {
+	var sb strings.Builder
+	if x := strings.TrimSpace(e.Explanation); x != "" {
+		sb.WriteString(clip(x, 300) + "\n")
+	}
+	for _, s := range e.Steps {
+		mark := "⬜"
+		switch s.Status {
+		case "completed":
+			mark = "✅"
+		case "in_progress":
+			mark = "🔄"
+		}
+		fmt.Fprintf(&sb, "%s %s\n", mark, clip(s.Step, 200))
+	}
+	return clip(sb.String(), 3500)
+}
+
+func renderFileChanges(files []codex.FileChange) string {
+	var sb strings.Builder
+	for i, f := range files {
+		if i == 20 {
+			fmt.Fprintf(&sb, "…ほか %d ファイル\n", len(files)-i)
+			break
+		}
+		name := f.Path
+		if f.MovePath != "" {
+			name += " → " + f.MovePath
+		}
+		switch f.Kind {
+		case "add":
+			fmt.Fprintf(&sb, "🆕 `%s` +%d\n", name, f.Added)
+		case "delete":
+			fmt.Fprintf(&sb, "🗑️ `%s` −%d\n", name, f.Removed)
+		default:
+			fmt.Fprintf(&sb, "✏️ `%s` +%d −%d\n", name, f.Added, f.Removed)
+		}
+	}
+	return sb.String()
+}
+
+// summarizeDiff extracts per-file line counts from a unified (git) diff.
+func summarizeDiff(diff string) []codex.FileChange {
+	_, files := diffFiles(diff)
+	var out []codex.FileChange
+	for _, f := range files {
+		out = append(out, summarizeDiffFile(f))
+	}
+	return out
+}
+
+// diffFiles splits a unified diff into the lines before the first file and
+// one section per file. A file starts at "diff --git" or at a "--- " header
+// that does not follow one; "---"/"+++" only count as headers outside a hunk.
+func diffFiles(diff string) (pre []string, files [][]string) {
+	var hunk codex.DiffHunk
+	gitHeader := false
+	for _, l := range strings.Split(diff, "\n") {
+		switch {
+		case hunk.Inside():
+			hunk.Line(l)
+		case strings.HasPrefix(l, "diff --git "):
+			files = append(files, nil)
+			gitHeader = true
+		case strings.HasPrefix(l, "--- "):
+			if !gitHeader {
+				files = append(files, nil)
+			}
+			gitHeader = false
+		case len(files) > 0:
+			hunk.Start(l)
+		}
+		if len(files) == 0 {
+			pre = append(pre, l)
+			continue
+		}
+		files[len(files)-1] = append(files[len(files)-1], l)
+	}
+	return pre, files
+}
+
+// summarizeDiffFile counts the lines of one section of diffFiles.
+func summarizeDiffFile(lines []string) codex.FileChange {
+	fc := codex.FileChange{Kind: "update"}
+	var hunk codex.DiffHunk
+	for _, l := range lines {
+		if hunk.Inside() {
+			switch hunk.Line(l) {
+			case '+':
+				fc.Added++
+			case '-':
+				fc.Removed++
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l, "diff --git "):
+			if _, after, ok := strings.Cut(l, " b/"); ok {
+				fc.Path = after
+			}
+		case strings.HasPrefix(l, "--- "):
+			if strings.TrimPrefix(l, "--- ") == "/dev/null" {
+				fc.Kind = "add"
+			}
+		case strings.HasPrefix(l, "+++ "):
+			p := strings.TrimPrefix(strings.TrimPrefix(l, "+++ "), "b/")
+			if p == "/dev/null" {
+				fc.Kind = "delete"
+			} else if fc.Path == "" {
+				fc.Path = p
+			}
+		default:
+			hunk.Start(l)
+		}
+	}
+	return fc
+}
+
+// dropDiffFiles removes the files under dir (slash-separated, relative like
+// the diff's paths) from a unified diff.
+func dropDiffFiles(diff, dir string) string {
+	if dir == "" || diff == "" {
+		return diff
+	}
+	pre, files := diffFiles(diff)
+	out := pre
+	for _, f := range files {
+		if p := summarizeDiffFile(f).Path; p == dir || strings.HasPrefix(p, dir+"/") {
+			continue
+		}
+		out = append(out, f...)
+	}
+	return strings.Join(out, "\n")
+}
+
+func codeBlock(lang, s string) string {
+	s = strings.ReplaceAll(s, "```", "`​``")
+	return "```" + lang + "\n" + s + "\n```"
+}
+
+// clipTail keeps the last n runes of s, which is usually the useful part of
+// command output.
+func clipTail(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return "…" + string(r[len(r)-n+1:])
+}
@@ -0,0 +1,175 @@
+package discordbot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aoisensi/discodex/internal/codex"
+)
+
+func TestSummarizeDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		diff string
+		want []codex.FileChange
+	}{
+		{
+			name: "empty",
+			diff: "",
+			want: nil,
+		},
+		{
+			name: "git update",
+			diff: "diff --git a/main.go b/main.go\n" +
+				"index 1111111..2222222 100644\n" +
+				"--- a/main.go\n" +
+				"+++ b/main.go\n" +
+				"@@ -1,3 +1,3 @@\n" +
+				" package main\n" +
+				"-var x = 1\n" +
+				"+var x = 2\n" +
+				" \n",
+			want: []codex.FileChange{{Path: "main.go", Kind: "update", Added: 1, Removed: 1}},
+		},
+		{
+			name: "git add and delete",
+			diff: "diff --git a/new.txt b/new.txt\n" +
+				"new file mode 100644\n" +
+				"--- /dev/null\n" +
+				"+++ b/new.txt\n" +
+				"@@ -0,0 +1,2 @@\n" +
+				"+a\n" +
+				"+b\n" +
+				"diff --git a/old.txt b/old.txt\n" +
+				"deleted file mode 100644\n" +
+				"--- a/old.txt\n" +
+				"+++ /dev/null\n" +
+				"@@ -1 +0,0 @@\n" +
+				"-gone\n",
+			want: []codex.FileChange{
+				{Path: "new.txt", Kind: "add", Added: 2},
+				{Path: "old.txt", Kind: "delete", Removed: 1},
+			},
+		},
+		{
+			name: "plain multi-file diff",
+			diff: "--- a/a.txt\n" +
+				"+++ b/a.txt\n" +
+				"@@ -1 +1 @@\n" +
+				"-x\n" +
+				"+y\n" +
+				"--- a/b.txt\n" +
+				"+++ b/b.txt\n" +
+				"@@ -1,2 +1,3 @@\n" +
+				" keep\n" +
+				"+one\n" +
+				"+two\n" +
+				"-keep2\n",
+			want: []codex.FileChange{
+				{Path: "a.txt", Kind: "update", Added: 1, Removed: 1},
+				{Path: "b.txt", Kind: "update", Added: 2, Removed: 1},
+			},
+		},
+		{
+			name: "removed SQL comment is not a header",
+			diff: "diff --git a/schema.sql b/schema.sql\n" +
+				"--- a/schema.sql\n" +
+				"+++ b/schema.sql\n" +
+				"@@ -1,3 +1,2 @@\n" +
+				"--- drop this comment\n" +
+				" CREATE TABLE t (id int);\n" +
+				"-DROP TABLE u;\n" +
+				"diff --git a/b.lua b/b.lua\n" +
+				"--- a/b.lua\n" +
+				"+++ b/b.lua\n" +
+				"@@ -1 +1 @@\n" +
+				"-x = 1\n" +
+				"+x = 2\n",
+			want: []codex.FileChange{
+				{Path: "schema.sql", Kind: "update", Removed: 2},
+				{Path: "b.lua", Kind: "update", Added: 1, Removed: 1},
+			},
+		},
+		{
+			name: "added line starting with ++ is not a header",
+			diff: "--- a/c.c\n" +
+				"+++ b/c.c\n" +
+				"@@ -1,1 +1,2 @@\n" +
+				" int i;\n" +
+				"+++ i;\n",
+			want: []codex.FileChange{{Path: "c.c", Kind: "update", Added: 1}},
+		},
+		{
+			name: "several hunks, no newline marker and an empty context line",
+			diff: "--- a/x\n" +
+				"+++ b/x\n" +
+				"@@ -1,2 +1,2 @@\n" +
+				"\n" +
+				"-a\n" +
+				"+b\n" +
+				"\\ No newline at end of file\n" +
+				"@@ -10 +10,0 @@ func f()\n" +
+				"--- c\n",
+			want: []codex.FileChange{{Path: "x", Kind: "update", Added: 1, Removed: 2}},
+		},
+		{
+			name: "hunk without a file header is ignored",
+			diff: "@@ -1 +1 @@\n-a\n+b\n",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarizeDiff(tt.diff); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("summarizeDiff\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropDiffFiles(t *testing.T) {
+	diff := "diff --git a/.discodex/attachments/1/a.txt b/.discodex/attachments/1/a.txt\n" +
+		"--- a/.discodex/attachments/1/a.txt\n" +
+		"+++ b/.discodex/attachments/1/a.txt\n" +
+		"@@ -1 +1 @@\n" +
+		"--- x\n" +
+		"+y\n" +
+		"diff --git a/main.go b/main.go\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -1 +1 @@\n" +
+		"-a\n" +
+		"+b\n"
+	want := "diff --git a/main.go b/main.go\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -1 +1 @@\n" +
+		"-a\n" +
+		"+b\n"
+	if got := dropDiffFiles(diff, ".discodex/attachments"); got != want {
+		t.Errorf("dropDiffFiles\n got %q\nwant %q", got, want)
+	}
+	if got := dropDiffFiles(diff, ""); got != diff {
+		t.Errorf("dropDiffFiles with no dir changed the diff")
+	}
+	if got := dropDiffFiles(diff, ".discodex/attach"); got != diff {
+		t.Errorf("dropDiffFiles matched a path prefix that is not a directory")
+	}
+}
+
+func TestForgetTurnEvents(t *testing.T) {
+	b := &Bot{
+		eventMsgs: map[string]*eventMsg{"1#7#call": {}, "1#7#plan": {}, "12#3#call": {}},
+		artifacts: map[string]*turnArtifacts{"1": {}, "12": {}},
+	}
+	b.forgetTurnEvents("1")
+	if _, ok := b.eventMsgs["12#3#call"]; !ok || len(b.eventMsgs) != 1 {
+		t.Errorf("eventMsgs left = %v, want only 12#3#call", b.eventMsgs)
+	}
+	if _, ok := b.artifacts["1"]; ok {
+		t.Errorf("artifacts of channel 1 kept")
+	}
+	if _, ok := b.artifacts["12"]; !ok {
+		t.Errorf("artifacts of channel 12 dropped")
+	}
+}
@@ -0,0 +1,100 @@
+package discordbot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const queuedEmoji = "⏳"
+
+// queueNote shows a waiting prompt's queue position: ⏳ on the prompt message
+// and a "queued #2" reply that is kept up to date and removed once it starts.
+type queueNote struct {
+	b *Bot
+	// channel for the note (the conversation's channel or thread)
+	channelID string
+	// the prompt message, if any (slash commands have none)
+	msgChannelID, messageID string
+
+	mu      sync.Mutex
+	noteID  string
+	waiting bool
+}
+
+// update is the codex.WithQueueNotify callback.
+func (q *queueNote) update(pos int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.b.session
+	if pos == 0 {
+		if q.waiting {
+			q.clear()
+		}
+		q.waiting = false
+		if q.noteID != "" {
+			_ = s.ChannelMessageDelete(q.channelID, q.noteID)
+			q.noteID = ""
+		}
+		return
+	}
+	text := fmt.Sprintf("%s 順番待ち #%d（前のターンが終わると開始。%s でキャンセル）", queuedEmoji, pos, cancelEmoji)
+	if q.messageID == "" {
+		text = fmt.Sprintf("%s 順番待ち #%d（前のターンが終わると開始）", queuedEmoji, pos)
+	}
+	if q.noteID != "" {
+		_, _ = s.ChannelMessageEdit(q.channelID, q.noteID, text)
+		return
+	}
+	q.waiting = true
+	if q.messageID != "" {
+		_ = s.MessageReactionAdd(q.msgChannelID, q.messageID, queuedEmoji)
+	}
+	send := &discordgo.MessageSend{Content: text}
+	if q.messageID != "" && q.msgChannelID == q.channelID {
+		send.Reference = &discordgo.MessageReference{MessageID: q.messageID, ChannelID: q.msgChannelID}
+	}
+	if msg, err := s.ChannelMessageSendComplex(q.channelID, send); err == nil {
+		q.noteID = msg.ID
+	}
+}
+
+// done is called when the prompt's turn is over; a prompt that never left the
+// queue was cancelled while waiting.
+func (q *queueNote) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.waiting {
+		return
+	}
+	q.waiting = false
+	q.clear()
+	if q.noteID != "" {
+		_, _ = q.b.session.ChannelMessageEdit(q.channelID, q.noteID, "⏹️ 順番待ちをキャンセルした")
+	}
+}
+
+func (q *queueNote) clear() {
+	if q.messageID != "" {
+		_ = q.b.session.MessageReactionRemove(q.msgChannelID, q.messageID, queuedEmoji, "@me")
+	}
+}
+
+// isWaiting reports whether the prompt is still queued.
+func (q *queueNote) isWaiting() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// pendingPrompt is a prompt message whose turn is queued or running.
+type pendingPrompt struct {
+	channelID string
+	// Discord user who sent the prompt
+	authorID string
+	// cancel drops the prompt while it is still queued
+	cancel context.CancelFunc
+	note   *queueNote
+}
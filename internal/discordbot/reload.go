@@ -0,0 +1,76 @@
+package discordbot
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// settings is the reloadable part of the bot configuration. It is replaced as
+// a whole, so handlers always see one consistent version.
+type settings struct {
+	channelMap   map[string]config.Channel
+	logChannelID string
+	attachments  config.Attachments
+	artifacts    config.Artifacts
+	acl          config.ACL
+	// [codex] defaults, for showing the effective channel settings
+	codex config.Codex
+}
+
+func defaultSettings() *settings {
+	return &settings{
+		channelMap:  map[string]config.Channel{},
+		attachments: config.Attachments{}.WithDefaults(),
+		artifacts:   config.Artifacts{}.WithDefaults(),
+	}
+}
+
+func (b *Bot) settings() *settings {
+	if s := b.conf.Load(); s != nil {
+		return s
+	}
+	return defaultSettings()
+}
+
+// update applies fn to a copy of the current settings and swaps it in.
+func (b *Bot) update(fn func(s *settings)) {
+	for {
+		cur := b.conf.Load()
+		next := defaultSettings()
+		if cur != nil {
+			c := *cur
+			next = &c
+		}
+		fn(next)
+		if b.conf.CompareAndSwap(cur, next) {
+			return
+		}
+	}
+}
+
+// Reload swaps in a new configuration: channel map, log channel, ACL,
+// attachment and artifact settings change together. Runtime overrides
+// (/codex model, /codex cwd) are kept.
+func (b *Bot) Reload(conf *config.Config) {
+	cmap := make(map[string]config.Channel, len(conf.Channels))
+	for _, ch := range conf.Channels {
+		cmap[ch.ChannelID] = ch
+	}
+	b.conf.Store(&settings{
+		channelMap:   cmap,
+		logChannelID: strings.TrimSpace(conf.Discord.LogChannelID),
+		attachments:  conf.Attachments.WithDefaults(),
+		artifacts:    conf.Artifacts.WithDefaults(),
+		acl:          conf.ACL,
+		codex:        conf.Codex,
+	})
+	slog.Debug("config: reloaded", "channels", len(cmap))
+}
+
+// ReportError posts err to the log channel (or the process log when none is
+// set).
+func (b *Bot) ReportError(tag string, err error) {
+	b.reportErrorf(tag, err)
+}
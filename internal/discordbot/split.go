@@ -0,0 +1,123 @@
+package discordbot
+
+import (
+	"strings"
+	"unicode"
+)
+
+// messageLimit is Discord's hard limit on message content, in characters.
+const messageLimit = 2000
+
+// fenceClose is appended to a chunk that ends inside a code block.
+const fenceClose = "\n```"
+
+// splitMarkdown splits s into chunks of at most limit runes. It prefers
+// paragraph breaks, then line breaks, then spaces. A chunk that ends inside a
+// fenced code block is closed with ``` and the next chunk reopens the fence
+// with the same info string (e.g. ```go), so every chunk renders on its own.
+// Splitting is deterministic from the start of s: growing s only ever changes
+// its last chunks, which the streaming renderer relies on.
+func splitMarkdown(s string, limit int) []string {
+	r := []rune(s)
+	fences := fenceStates(r)
+	var out []string
+	pos := 0
+	open := ""
+	for pos < len(r) {
+		prefix := ""
+		if open != "" {
+			prefix = open + "\n"
+		}
+		budget := limit - runeLen(prefix)
+		if len(r)-pos <= budget {
+			if chunk := strings.TrimRightFunc(prefix+string(r[pos:]), unicode.IsSpace); strings.TrimSpace(chunk) != "" {
+				out = append(out, chunk)
+			}
+			break
+		}
+		// leave room to close a fence that is still open at the cut
+		budget -= runeLen(fenceClose)
+		if budget < 1 {
+			budget = 1
+		}
+		cut := pos + bestCut(r[pos:], budget)
+		chunk := prefix + string(r[pos:cut])
+		next := fences[cut]
+		if next != "" {
+			chunk = strings.TrimRight(chunk, "\n") + fenceClose
+		} else {
+			chunk = strings.TrimRightFunc(chunk, unicode.IsSpace)
+			// don't start the next chunk with blank lines
+			for cut < len(r) && r[cut] == '\n' {
+				cut++
+			}
+		}
+		if strings.TrimSpace(chunk) != "" {
+			out = append(out, chunk)
+		}
+		pos, open = cut, next
+	}
+	return out
+}
+
+// bestCut returns where to end a chunk of at most n runes taken from the
+// start of r: after the last blank line, else after the last line break, else
+// after the last space, falling back to a hard cut. A line break right after
+// the window counts too, since trailing newlines are trimmed from the chunk.
+// Breaks in the first half are ignored so chunks don't become tiny.
+func bestCut(r []rune, n int) int {
+	last := n - 1
+	if n < len(r) && r[n] == '\n' {
+		last = n
+	}
+	min := n / 2
+	for i := last; i > min; i-- {
+		if r[i] == '\n' && r[i-1] == '\n' {
+			return i + 1
+		}
+	}
+	for i := last; i >= min; i-- {
+		if r[i] == '\n' {
+			return i + 1
+		}
+	}
+	for i := n - 1; i >= min; i-- {
+		if unicode.IsSpace(r[i]) {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// fenceStates reports, for every rune offset of r (and len(r)), the opening
+// fence line (e.g. "```go") of the code block that offset is inside, or "".
+// A position on a fence line itself takes the state at the start of that line.
+func fenceStates(r []rune) []string {
+	states := make([]string, len(r)+1)
+	open := ""
+	lineStart := 0
+	for i := 0; i <= len(r); i++ {
+		if i < len(r) && r[i] != '\n' {
+			continue
+		}
+		for j := lineStart; j <= i; j++ {
+			states[j] = open
+		}
+		line := strings.TrimLeft(string(r[lineStart:i]), " ")
+		if strings.HasPrefix(line, "```") {
+			if open == "" {
+				open = strings.TrimSpace(line)
+			} else if strings.Trim(strings.TrimSpace(line), "`") == "" {
+				open = ""
+			}
+		}
+		lineStart = i + 1
+		if i < len(r) {
+			// the position right after the newline belongs to the next line
+			states[i+1] = open
+		}
+	}
+	return states
+}
+
+func runeLen(s string) int { return len([]rune(s)) }
@@ -0,0 +1,177 @@
+package discordbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		limit int
+		want  []string
+	}{
+		{
+			name:  "empty",
+			in:    "",
+			limit: 20,
+			want:  nil,
+		},
+		{
+			name:  "whitespace only",
+			in:    " \n\n ",
+			limit: 20,
+			want:  nil,
+		},
+		{
+			name:  "fits",
+			in:    "hello world",
+			limit: 20,
+			want:  []string{"hello world"},
+		},
+		{
+			name:  "exactly the limit",
+			in:    strings.Repeat("a", 20),
+			limit: 20,
+			want:  []string{strings.Repeat("a", 20)},
+		},
+		{
+			name:  "prefers paragraph break",
+			in:    "first para\n\nsecond line\nthird",
+			limit: 24,
+			want:  []string{"first para", "second line\nthird"},
+		},
+		{
+			name:  "prefers line break over space",
+			in:    "line one here\nline two here",
+			limit: 20,
+			want:  []string{"line one here", "line two here"},
+		},
+		{
+			name:  "breaks at spaces, not inside words",
+			in:    "alpha beta gamma delta epsilon",
+			limit: 16,
+			want:  []string{"alpha beta", "gamma delta", "epsilon"},
+		},
+		{
+			name:  "hard cut without any break",
+			in:    strings.Repeat("x", 25),
+			limit: 14,
+			want:  []string{strings.Repeat("x", 10), strings.Repeat("x", 10), strings.Repeat("x", 5)},
+		},
+		{
+			name:  "multi-byte runes are never cut",
+			in:    strings.Repeat("日本語", 6),
+			limit: 12,
+			want:  []string{"日本語日本語日本", "語日本語日本語日本語"},
+		},
+		{
+			name:  "japanese full-width space is a break",
+			in:    "こんにちは　世界のみなさん",
+			limit: 12,
+			want:  []string{"こんにちは", "世界のみなさん"},
+		},
+		{
+			name:  "code fence is closed and reopened with its language",
+			in:    "```go\nline1\nline2\nline3\n```",
+			limit: 21,
+			want:  []string{"```go\nline1\nline2\n```", "```go\nline3\n```"},
+		},
+		{
+			name:  "text after a closed fence is not reopened",
+			in:    "```\ncode\n```\nafter the block\nmore text",
+			limit: 24,
+			want:  []string{"```\ncode\n```", "after the block", "more text"},
+		},
+		{
+			name:  "leading blank lines of the next chunk are dropped",
+			in:    "aaaa bbbb\n\n\n\ncccc dddd",
+			limit: 14,
+			want:  []string{"aaaa bbbb", "cccc dddd"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMarkdown(tt.in, tt.limit)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitMarkdown(%q, %d)\n got %q\nwant %q", tt.in, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSplitMarkdownInvariants checks properties every split must keep,
+// whatever the input: the limit, valid UTF-8, balanced fences and no lost text.
+func TestSplitMarkdownInvariants(t *testing.T) {
+	long := strings.Repeat("本文のテキスト。", 40)
+	code := "```python\n" + strings.Repeat("print('こんにちは')\n", 60) + "```"
+	tests := []struct {
+		name  string
+		in    string
+		limit int
+	}{
+		{"japanese prose", long, 100},
+		{"long code block", code, 200},
+		{"prose around code", long + "\n\n" + code + "\n\n" + long, 300},
+		{"two code blocks", code + "\ntext\n" + strings.Replace(code, "python", "sh", 1), 150},
+		{"discord limit", strings.Repeat(long+"\n"+code+"\n", 5), messageLimit},
+		{"long words", strings.Repeat("supercalifragilistic", 30), 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := splitMarkdown(tt.in, tt.limit)
+			if len(parts) < 2 {
+				t.Fatalf("expected a split, got %d part(s)", len(parts))
+			}
+			var rebuilt strings.Builder
+			for i, p := range parts {
+				if n := utf8.RuneCountInString(p); n > tt.limit {
+					t.Errorf("part %d has %d runes, limit %d", i, n, tt.limit)
+				}
+				if !utf8.ValidString(p) {
+					t.Errorf("part %d is not valid UTF-8", i)
+				}
+				if fences := strings.Count(p, "```"); fences%2 != 0 {
+					t.Errorf("part %d has unbalanced fences:\n%s", i, p)
+				}
+				rebuilt.WriteString(p + "\n")
+			}
+			// every non-space rune of the input survives (fences may be added)
+			if want, got := stripSplitNoise(tt.in), stripSplitNoise(rebuilt.String()); want != got {
+				t.Errorf("text lost or reordered across parts")
+			}
+		})
+	}
+}
+
+func TestSplitMarkdownIsStableWhileGrowing(t *testing.T) {
+	text := strings.Repeat("streaming reply text\n```js\nconsole.log(1)\n```\n", 40)
+	r := []rune(text)
+	prev := splitMarkdown(string(r[:100]), 300)
+	for n := 101; n <= len(r); n += 37 {
+		cur := splitMarkdown(string(r[:n]), 300)
+		// all but the last previous chunk must be unchanged
+		for i := 0; i < len(prev)-1; i++ {
+			if i >= len(cur) || cur[i] != prev[i] {
+				t.Fatalf("chunk %d changed after growing to %d runes", i, n)
+			}
+		}
+		prev = cur
+	}
+}
+
+// stripSplitNoise removes what splitting may add or drop: whitespace and
+// fence lines.
+func stripSplitNoise(s string) string {
+	var sb strings.Builder
+	for _, l := range strings.Split(s, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(l), "```") {
+			continue
+		}
+		sb.WriteString(strings.Join(strings.Fields(l), ""))
+	}
+	return sb.String()
+}
@@ -0,0 +1,58 @@
+package discordbot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/codex"
+)
+
+// NotifyGaveUp tells the channels that used a crash-looping Codex process (and
+// the log channel) that it is not restarted until its cooldown has passed.
+func (b *Bot) NotifyGaveUp(channelIDs []string, err error) {
+	if b.session == nil {
+		return
+	}
+	msg := "⚠️ Codex のプロセスが異常終了を繰り返したため、再起動をいったん止めた"
+	var ce *codex.CrashLoopError
+	if errors.As(err, &ce) {
+		msg += fmt.Sprintf("（%s 以降の発言で再試行する）", ce.RetryAt.Format("15:04"))
+	}
+	logID := b.settings().logChannelID
+	for _, id := range channelIDs {
+		if id != logID {
+			b.sendText(id, msg)
+		}
+	}
+	b.reportErrorf("codex", err)
+}
+
+// ReportExit posts an unexpected Codex process exit, with the end of its
+// stderr, to the log channel.
+func (b *Bot) ReportExit(err *codex.ExitError) {
+	b.reportErrorf("codex", err)
+}
+
+// stderrBlock formats the stderr lines of an exited process for a report.
+func stderrBlock(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	body := strings.ReplaceAll(strings.Join(lines, "\n"), "```", "'''")
+	return "\nstderr（末尾）:\n```\n" + clipTail(body, 1500) + "\n```"
+}
+
+// processErrorMessage explains a turn that failed because its Codex process
+// exited or is given up on; "" for any other error.
+func processErrorMessage(err error) string {
+	var ce *codex.CrashLoopError
+	if errors.As(err, &ce) {
+		return fmt.Sprintf("⚠️ Codex のプロセスが異常終了を繰り返しているため停止中。%s 以降にもう一度送ってほしい", ce.RetryAt.Format("15:04"))
+	}
+	var ee *codex.ExitError
+	if errors.As(err, &ee) {
+		return "⚠️ Codex のプロセスが途中で終了したため中断した。自動で再起動するので、少し待ってからもう一度送ってほしい（会話は新しく始まる）"
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package discordbot
+
+import (
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/bwmarrin/discordgo"
+)
+
+// threadParent returns the mapped thread-mode channel that owns threadID.
+func (b *Bot) threadParent(threadID string) (config.Channel, bool) {
+	if b.session == nil || b.session.State == nil {
+		return config.Channel{}, false
+	}
+	c, err := b.session.State.Channel(threadID)
+	if err != nil || !c.IsThread() {
+		return config.Channel{}, false
+	}
+	parent, ok := b.settings().channelMap[c.ParentID]
+	if !ok || !parent.Threads {
+		return config.Channel{}, false
+	}
+	return parent, true
+}
+
+// startThread opens a thread on the prompt message; the thread becomes the
+// conversation key and reply destination.
+func (b *Bot) startThread(m *discordgo.MessageCreate, prompt string) (string, error) {
+	th, err := b.session.MessageThreadStartComplex(m.ChannelID, m.ID, &discordgo.ThreadStart{
+		Name:                threadName(prompt),
+		AutoArchiveDuration: 1440,
+	})
+	if err != nil {
+		return "", err
+	}
+	return th.ID, nil
+}
+
+// threadName derives a thread title from the first line of the prompt.
+func threadName(prompt string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "codex"
+	}
+	return clip(line, 90)
+}
+
+// onThreadUpdate resets the thread's conversation once it is archived.
+func (b *Bot) onThreadUpdate(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	if t.Channel == nil || t.ThreadMetadata == nil || !t.ThreadMetadata.Archived {
+		return
+	}
+	b.resetThread(t.Channel)
+}
+
+// onThreadDelete resets the conversation of a deleted thread.
+func (b *Bot) onThreadDelete(s *discordgo.Session, t *discordgo.ThreadDelete) {
+	if t.Channel == nil {
+		return
+	}
+	b.resetThread(t.Channel)
+}
+
+func (b *Bot) resetThread(c *discordgo.Channel) {
+	parent, ok := b.settings().channelMap[c.ParentID]
+	if !ok || !parent.Threads || b.onReset == nil {
+		return
+	}
+	ch, mapped := b.channel(c.ID)
+	if !mapped {
+		// state no longer knows the thread; reset by id with the parent's settings
+		ch = parent
+		ch.ChannelID = c.ID
+	}
+	if err := b.resetChannel(ch); err != nil {
+		b.reportErrorf("thread reset", err)
+	}
+}
@@ -0,0 +1,69 @@
+package discordbot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/codex"
+	"github.com/aoisensi/discodex/internal/config"
+	"github.com/aoisensi/discodex/internal/store"
+)
+
+func renderUsage(ch config.Channel, r codex.UsageReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "**discodex usage** <#%s>\n", ch.ChannelID)
+	fmt.Fprintf(&sb, "- 直近のターン: %s\n", formatUsage(r.LastTurn))
+	fmt.Fprintf(&sb, "- この会話: %s\n", formatUsage(r.Conversation))
+	sb.WriteString("**チャンネル**\n")
+	fmt.Fprintf(&sb, "- 今日: %s\n", formatBudget(r.ChannelDaily, r.Quota.ChannelDailyTokens))
+	fmt.Fprintf(&sb, "- 今月: %s\n", formatBudget(r.ChannelMonthly, r.Quota.ChannelMonthlyTokens))
+	fmt.Fprintf(&sb, "- 累計: %s\n", formatTokens(r.ChannelTotal.Total))
+	sb.WriteString("**あなた**\n")
+	fmt.Fprintf(&sb, "- 今日: %s\n", formatBudget(r.UserDaily, r.Quota.UserDailyTokens))
+	fmt.Fprintf(&sb, "- 今月: %s\n", formatBudget(r.UserMonthly, r.Quota.UserMonthlyTokens))
+	fmt.Fprintf(&sb, "- 累計: %s\n", formatTokens(r.UserTotal.Total))
+	return sb.String()
+}
+
+func formatUsage(u store.Usage) string {
+	if u == (store.Usage{}) {
+		return "0"
+	}
+	return fmt.Sprintf("%s（入力 %s / 出力 %s）", formatTokens(u.Total), formatTokens(u.Input), formatTokens(u.Output))
+}
+
+func formatBudget(u store.Usage, limit int64) string {
+	if limit <= 0 {
+		return formatTokens(u.Total) + "（上限なし）"
+	}
+	return fmt.Sprintf("%s / %s", formatTokens(u.Total), formatTokens(limit))
+}
+
+// formatTokens groups digits: 1234567 -> 1,234,567.
+func formatTokens(n int64) string {
+	s := fmt.Sprintf("%d", n)
+	if n < 0 {
+		return s
+	}
+	var sb strings.Builder
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// quotaMessage explains a refused prompt.
+func quotaMessage(e *codex.QuotaError) string {
+	who := "このチャンネル"
+	if e.Scope == "user" {
+		who = "あなた"
+	}
+	period := "今日"
+	if e.Period == "monthly" {
+		period = "今月"
+	}
+	return fmt.Sprintf("⛔ %sの%sのトークン上限に達したため受け付けられない（%s / %s）。`/codex usage` で確認できる", who, period, formatTokens(e.Used), formatTokens(e.Limit))
+}
@@ -0,0 +1,157 @@
+// Package logging sets up log/slog for discodex and carries the attributes
+// that tie the log lines of one turn together (Discord message, channel, user,
+// JSON-RPC request, conversation) through a context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// Keys of the correlation attributes.
+const (
+	KeyMessage      = "discord_message_id"
+	KeyInteraction  = "discord_interaction_id"
+	KeyChannel      = "channel"
+	KeyUser         = "user"
+	KeyRPC          = "rpc_id"
+	KeyConversation = "conversation_id"
+)
+
+var level = new(slog.LevelVar)
+
+// Setup installs the default logger. The environment (DISCODEX_LOG_LEVEL,
+// DISCODEX_LOG_FORMAT) takes precedence over conf; DISCODEX_DEBUG and
+// [codex].debug still mean level debug. Lines written through the log package
+// end up here too.
+func Setup(conf *config.Config) {
+	SetLevel(conf)
+	format := strings.ToLower(strings.TrimSpace(conf.Log.Format))
+	if v := strings.TrimSpace(os.Getenv("DISCODEX_LOG_FORMAT")); v != "" {
+		format = strings.ToLower(v)
+	}
+	slog.SetDefault(slog.New(&handler{Handler: newHandler(os.Stderr, format)}))
+}
+
+func newHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// SetLevel applies the level of conf (and the environment); Reload calls it so
+// the level changes without a restart.
+func SetLevel(conf *config.Config) {
+	l := slog.LevelInfo
+	name := strings.TrimSpace(conf.Log.Level)
+	if v := strings.TrimSpace(os.Getenv("DISCODEX_LOG_LEVEL")); v != "" {
+		name = v
+	}
+	if name != "" {
+		_ = l.UnmarshalText([]byte(name))
+	} else if conf.Codex.Debug || envDebug() {
+		l = slog.LevelDebug
+	}
+	level.Set(l)
+}
+
+func envDebug() bool {
+	v, ok := os.LookupEnv("DISCODEX_DEBUG")
+	return ok && v != "" && v != "0" && strings.ToLower(v) != "false"
+}
+
+// Debug reports whether debug lines are written; use it to skip building
+// expensive ones.
+func Debug() bool { return level.Level() <= slog.LevelDebug }
+
+// redact hides registered secrets in every string value, and in errors,
+// maps, structs and other values by their fmt rendering; such a value is
+// replaced by its redacted rendering only when it contains a secret.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(config.Redact(a.Value.String()))
+	case slog.KindAny:
+		s := fmt.Sprintf("%+v", a.Value.Any())
+		if r := config.Redact(s); r != s {
+			a.Value = slog.StringValue(r)
+		}
+	}
+	return a
+}
+
+type ctxKey struct{}
+
+// With returns ctx carrying attributes (key/value pairs as in slog) that are
+// added to every record logged with that context. A key already on ctx is
+// replaced; empty strings are left out.
+func With(ctx context.Context, args ...any) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	r := slog.Record{}
+	r.Add(args...)
+	var add []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Value.Kind() != slog.KindString || a.Value.String() != "" {
+			add = append(add, a)
+		}
+		return true
+	})
+	prev, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	attrs := make([]slog.Attr, 0, len(prev)+len(add))
+	for _, a := range prev {
+		replaced := false
+		for _, b := range add {
+			if a.Key == b.Key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			attrs = append(attrs, a)
+		}
+	}
+	return context.WithValue(ctx, ctxKey{}, append(attrs, add...))
+}
+
+// handler adds the context's attributes to each record.
+type handler struct {
+	slog.Handler
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+			// the record's own attributes win over the context's
+			own := map[string]bool{}
+			r.Attrs(func(a slog.Attr) bool {
+				own[a.Key] = true
+				return true
+			})
+			r = r.Clone()
+			for _, a := range attrs {
+				if !own[a.Key] {
+					r.AddAttrs(a)
+				}
+			}
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{Handler: h.Handler.WithGroup(name)}
+}
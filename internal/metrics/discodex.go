@@ -0,0 +1,38 @@
+package metrics
+
+// Buckets for turn latencies: Codex turns take from seconds to many minutes.
+var turnBuckets = []float64{0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600, 1200}
+
+// The metrics discodex exports. Channel labels are the configured channel
+// (the parent for threads) so that threads do not each start a series.
+var (
+	Requests = NewCounter("discodex_requests_total",
+		"Prompts handled, by channel, backend and result (ok, error, cancelled, quota).",
+		"channel", "backend", "result")
+	RequestDuration = NewHistogram("discodex_request_duration_seconds",
+		"Time from receiving a prompt to the end of its turn, including the queue wait.",
+		turnBuckets, "channel", "backend")
+	FirstDelta = NewHistogram("discodex_first_delta_seconds",
+		"Time from sending tools/call to the first agent_message_delta.",
+		turnBuckets, "channel")
+	Tokens = NewCounter("discodex_tokens_total",
+		"Tokens reported by token_count events, by type (input, cached_input, output, reasoning).",
+		"channel", "type")
+	QueueDepth = NewGauge("discodex_queue_depth",
+		"Prompts waiting behind the running turn of a conversation (channel or thread).",
+		"channel")
+
+	MCPRestarts = NewCounter("discodex_mcp_restarts_total",
+		"Automatic restarts of codex mcp processes after a crash.",
+		"workdir")
+	MCPUptime = NewGauge("discodex_mcp_uptime_seconds",
+		"Seconds since the running codex mcp process started.",
+		"workdir")
+	MCPPending = NewGauge("discodex_mcp_pending_requests",
+		"JSON-RPC requests waiting for a response.",
+		"workdir")
+
+	DiscordErrors = NewCounter("discodex_discord_api_errors_total",
+		"Failed Discord API calls, by operation (send, edit).",
+		"op")
+)
@@ -0,0 +1,258 @@
+// Package metrics is a small Prometheus text-format exporter: counters,
+// gauges and histograms with labels, served over HTTP.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kind string
+
+const (
+	kindCounter   kind = "counter"
+	kindGauge     kind = "gauge"
+	kindHistogram kind = "histogram"
+)
+
+// Vec is a metric family: one series per combination of label values.
+type Vec struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// histogram only: per-bucket (non-cumulative) counts
+	counts []uint64
+	count  uint64
+}
+
+var (
+	regMu    sync.Mutex
+	registry []*Vec
+	hooks    []func()
+)
+
+func newVec(name, help string, k kind, buckets []float64, labels []string) *Vec {
+	v := &Vec{name: name, help: help, kind: k, labels: labels, buckets: buckets, series: map[string]*series{}}
+	regMu.Lock()
+	registry = append(registry, v)
+	regMu.Unlock()
+	return v
+}
+
+// NewCounter registers a counter.
+func NewCounter(name, help string, labels ...string) *Vec {
+	return newVec(name, help, kindCounter, nil, labels)
+}
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string, labels ...string) *Vec {
+	return newVec(name, help, kindGauge, nil, labels)
+}
+
+// NewHistogram registers a histogram with the given upper bounds.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Vec {
+	return newVec(name, help, kindHistogram, buckets, labels)
+}
+
+// OnCollect registers fn to run before every scrape, to set gauges that are
+// read from state rather than updated as things happen.
+func OnCollect(fn func()) {
+	regMu.Lock()
+	hooks = append(hooks, fn)
+	regMu.Unlock()
+}
+
+func (v *Vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s := v.series[key]
+	if s == nil {
+		s = &series{values: append([]string(nil), values...)}
+		if v.kind == kindHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Inc adds 1.
+func (v *Vec) Inc(values ...string) { v.Add(1, values...) }
+
+// Add adds delta (counters and gauges).
+func (v *Vec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+// Set sets a gauge.
+func (v *Vec) Set(val float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value = val
+	v.mu.Unlock()
+}
+
+// Observe records a histogram sample.
+func (v *Vec) Observe(val float64, values ...string) {
+	v.mu.Lock()
+	s := v.get(values)
+	for i, ub := range v.buckets {
+		if val <= ub {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.value += val
+	v.mu.Unlock()
+}
+
+// ObserveSince records the seconds elapsed since t.
+func (v *Vec) ObserveSince(t time.Time, values ...string) {
+	v.Observe(time.Since(t).Seconds(), values...)
+}
+
+// Delete drops a series, e.g. a gauge for a process that is gone.
+func (v *Vec) Delete(values ...string) {
+	v.mu.Lock()
+	delete(v.series, strings.Join(values, "\x00"))
+	v.mu.Unlock()
+}
+
+// Reset drops every series; collect hooks use it before setting the current ones.
+func (v *Vec) Reset() {
+	v.mu.Lock()
+	v.series = map[string]*series{}
+	v.mu.Unlock()
+}
+
+// Write writes every registered metric in the Prometheus text format.
+func Write(w io.Writer) error {
+	regMu.Lock()
+	vecs := append([]*Vec(nil), registry...)
+	fns := append([]func(){}, hooks...)
+	regMu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+	sort.Slice(vecs, func(i, j int) bool { return vecs[i].name < vecs[j].name })
+	var sb strings.Builder
+	for _, v := range vecs {
+		v.write(&sb)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (v *Vec) write(sb *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(sb, "# TYPE %s %s\n", v.name, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != kindHistogram {
+			fmt.Fprintf(sb, "%s%s %s\n", v.name, v.labelSet(s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+		var cum uint64
+		for i, ub := range v.buckets {
+			cum += s.counts[i]
+			fmt.Fprintf(sb, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, "le", formatFloat(ub)), cum)
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", v.name, v.labelSet(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(sb, "%s_sum%s %s\n", v.name, v.labelSet(s.values, "", ""), formatFloat(s.value))
+		fmt.Fprintf(sb, "%s_count%s %d\n", v.name, v.labelSet(s.values, "", ""), s.count)
+	}
+}
+
+// labelSet renders {a="x",b="y"}, with an extra label (le) when given.
+func (v *Vec) labelSet(values []string, extra, extraValue string) string {
+	if len(v.labels) == 0 && extra == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(v.labels)+1)
+	for i, l := range v.labels {
+		parts = append(parts, l+`="`+escapeValue(values[i])+`"`)
+	}
+	if extra != "" {
+		parts = append(parts, extra+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeValue(s string) string { return valueEscaper.Replace(s) }
+
+// Handler serves the metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = Write(w)
+	})
+}
+
+// Serve listens on addr and serves /metrics until ctx is done.
+func Serve(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+	}()
+	slog.Info("metrics: listening", "addr", ln.Addr().String())
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
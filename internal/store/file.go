@@ -0,0 +1,139 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File is an embedded store backed by a single JSON file. Every change
+// rewrites the file atomically (temp file + rename).
+type File struct {
+	mu   sync.Mutex
+	path string
+	data snapshot
+}
+
+// OpenFile loads path, creating an empty store if it does not exist yet.
+func OpenFile(path string) (*File, error) {
+	f := &File{path: path, data: newSnapshot()}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.data); err != nil {
+		return nil, err
+	}
+	if f.data.Conversations == nil {
+		f.data.Conversations = map[string]Conversation{}
+	}
+	if f.data.Streams == nil {
+		f.data.Streams = map[string]Stream{}
+	}
+	if f.data.Usage == nil {
+		f.data.Usage = map[string]Usage{}
+	}
+	return f, nil
+}
+
+func (f *File) Conversations() ([]Conversation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.conversations(), nil
+}
+
+func (f *File) PutConversation(c Conversation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data.Conversations[c.Key] = c
+	return f.flush()
+}
+
+func (f *File) DeleteConversation(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data.Conversations[key]; !ok {
+		return nil
+	}
+	delete(f.data.Conversations, key)
+	return f.flush()
+}
+
+func (f *File) AddUsage(keys []string, u Usage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data.addUsage(keys, u)
+	return f.flush()
+}
+
+func (f *File) Usage(key string) (Usage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.Usage[key], nil
+}
+
+func (f *File) PruneUsage(drop func(key string) bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.data.pruneUsage(drop) {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *File) Streams() ([]Stream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.data.streams(), nil
+}
+
+func (f *File) PutStream(st Stream) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data.Streams[st.MessageID] = st
+	return f.flush()
+}
+
+func (f *File) DeleteStream(messageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data.Streams[messageID]; !ok {
+		return nil
+	}
+	delete(f.data.Streams, messageID)
+	return f.flush()
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flush()
+}
+
+// flush writes the snapshot; callers hold f.mu.
+func (f *File) flush() error {
+	b, err := json.MarshalIndent(f.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(f.path)
+	tmp, err := os.CreateTemp(dir, ".discodex-state-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
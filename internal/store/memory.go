@@ -0,0 +1,123 @@
+package store
+
+import (
+	"sort"
+	"sync"
+)
+
+// Memory keeps state in process memory only (nothing survives a restart).
+type Memory struct {
+	mu   sync.Mutex
+	data snapshot
+}
+
+// snapshot is the whole persisted state; File serializes it as JSON.
+type snapshot struct {
+	Conversations map[string]Conversation `json:"conversations"`
+	Streams       map[string]Stream       `json:"streams"`
+	Usage         map[string]Usage        `json:"usage"`
+}
+
+func newSnapshot() snapshot {
+	return snapshot{Conversations: map[string]Conversation{}, Streams: map[string]Stream{}, Usage: map[string]Usage{}}
+}
+
+func NewMemory() *Memory { return &Memory{data: newSnapshot()} }
+
+func (s *Memory) Conversations() ([]Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.conversations(), nil
+}
+
+func (s *Memory) PutConversation(c Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Conversations[c.Key] = c
+	return nil
+}
+
+func (s *Memory) DeleteConversation(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Conversations, key)
+	return nil
+}
+
+func (s *Memory) AddUsage(keys []string, u Usage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.addUsage(keys, u)
+	return nil
+}
+
+func (s *Memory) Usage(key string) (Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.Usage[key], nil
+}
+
+func (s *Memory) PruneUsage(drop func(key string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.pruneUsage(drop)
+	return nil
+}
+
+func (s *Memory) Streams() ([]Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.streams(), nil
+}
+
+func (s *Memory) PutStream(st Stream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Streams[st.MessageID] = st
+	return nil
+}
+
+func (s *Memory) DeleteStream(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data.Streams, messageID)
+	return nil
+}
+
+func (s *Memory) Close() error { return nil }
+
+func (d snapshot) conversations() []Conversation {
+	out := make([]Conversation, 0, len(d.Conversations))
+	for _, c := range d.Conversations {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func (d snapshot) streams() []Stream {
+	out := make([]Stream, 0, len(d.Streams))
+	for _, st := range d.Streams {
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+func (d snapshot) addUsage(keys []string, u Usage) {
+	for _, k := range keys {
+		d.Usage[k] = d.Usage[k].Add(u)
+	}
+}
+
+// pruneUsage deletes the matching counters and reports whether any were.
+func (d snapshot) pruneUsage(drop func(key string) bool) bool {
+	pruned := false
+	for k := range d.Usage {
+		if drop(k) {
+			delete(d.Usage, k)
+			pruned = true
+		}
+	}
+	return pruned
+}
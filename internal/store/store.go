@@ -0,0 +1,84 @@
+// Package store persists discodex state (conversation ids, in-flight stream
+// messages, token usage) so it survives bot restarts and MCP idle shutdowns.
+package store
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aoisensi/discodex/internal/config"
+)
+
+// Conversation maps a Discord channel (or thread) to a Codex conversation.
+type Conversation struct {
+	// Key is the Discord channel or thread ID the conversation belongs to.
+	Key            string `json:"key"`
+	ConversationID string `json:"conversation_id"`
+	// RolloutPath is the Codex session file, used to resume after a restart.
+	RolloutPath string    `json:"rollout_path,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastActive  time.Time `json:"last_active"`
+}
+
+// Stream is a Discord message that was being streamed into.
+type Stream struct {
+	ChannelID string    `json:"channel_id"`
+	MessageID string    `json:"message_id"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Usage is a token counter (from Codex token_count events).
+type Usage struct {
+	Input       int64 `json:"input"`
+	CachedInput int64 `json:"cached_input,omitempty"`
+	Output      int64 `json:"output"`
+	Reasoning   int64 `json:"reasoning,omitempty"`
+	Total       int64 `json:"total"`
+}
+
+// Add returns the sum of u and v.
+func (u Usage) Add(v Usage) Usage {
+	return Usage{
+		Input:       u.Input + v.Input,
+		CachedInput: u.CachedInput + v.CachedInput,
+		Output:      u.Output + v.Output,
+		Reasoning:   u.Reasoning + v.Reasoning,
+		Total:       u.Total + v.Total,
+	}
+}
+
+// Store is the persistence backend.
+type Store interface {
+	Conversations() ([]Conversation, error)
+	PutConversation(c Conversation) error
+	DeleteConversation(key string) error
+
+	// AddUsage adds u to every counter in keys; Usage reads one counter.
+	AddUsage(keys []string, u Usage) error
+	Usage(key string) (Usage, error)
+	// PruneUsage deletes the counters whose key drop reports.
+	PruneUsage(drop func(key string) bool) error
+
+	Streams() ([]Stream, error)
+	PutStream(s Stream) error
+	DeleteStream(messageID string) error
+
+	Close() error
+}
+
+// New opens the store selected by [state].driver (file by default).
+func New(conf config.State) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(conf.Driver)) {
+	case "", "file":
+		path := strings.TrimSpace(conf.Path)
+		if path == "" {
+			path = "discodex-state.json"
+		}
+		return OpenFile(path)
+	case "memory":
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown state driver: %q", conf.Driver)
+	}
+}